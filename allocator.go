@@ -0,0 +1,177 @@
+package dsstore
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+// ErrNoSpace is returned when the allocator has no free block of the requested size
+var ErrNoSpace = errors.New("no free space for the block")
+
+// minBlockWidth is log2 of the smallest block size
+const minBlockWidth = 5
+
+// maxBlockWidth is log2 of the biggest block size
+const maxBlockWidth = 31
+
+// Allocator is the buddy allocator of the .DS_Store blocks.
+// Every block has the size of power of 2 (32 bytes at least) and it is aligned to its size.
+// Free blocks are kept by sizes the same way as Finder keeps them in the root block.
+type Allocator struct {
+	free [32][]uint32 // sorted offsets of free blocks by log2 of size
+}
+
+// NewAllocator returns the allocator of the empty file. The first 32 bytes are used by the header
+func NewAllocator() *Allocator {
+	a := new(Allocator)
+	for i := minBlockWidth; i < maxBlockWidth; i++ {
+		a.free[i] = []uint32{1 << uint(i)}
+	}
+	return a
+}
+
+// FreeBlocks returns offsets of free blocks by log2 of size
+func (a *Allocator) FreeBlocks() [][]uint32 {
+	freeBlocks := make([][]uint32, len(a.free))
+	for i, offsets := range a.free {
+		freeBlocks[i] = append([]uint32{}, offsets...)
+	}
+	return freeBlocks
+}
+
+// Alloc allocates the block for size bytes and returns its offset value (offset | log2 of size)
+func (a *Allocator) Alloc(size uint32) (uint32, error) {
+	width := uint32(minBlockWidth)
+	for width < maxBlockWidth && uint32(1)<<width < size {
+		width++
+	}
+	if uint32(1)<<width < size {
+		return 0, ErrNoSpace
+	}
+	// find the smallest free block
+	i := width
+	for i < maxBlockWidth && len(a.free[i]) == 0 {
+		i++
+	}
+	if len(a.free[i]) == 0 {
+		return 0, ErrNoSpace
+	}
+	offset := a.free[i][0]
+	a.free[i] = a.free[i][1:]
+	// split it by halves, second halves become free
+	for i > width {
+		i--
+		a.insert(i, offset+uint32(1)<<i)
+	}
+	return offset | width, nil
+}
+
+// Free releases the block by its offset value and merges it with free buddies
+func (a *Allocator) Free(value uint32) error {
+	offset, width := blockOffset(value), value&0x1f
+	if width < minBlockWidth || offset&(uint32(1)<<width-1) != 0 {
+		return ErrBadBlock
+	}
+	if a.overlaps(width, offset) {
+		return errors.New("block is already free")
+	}
+	for width < maxBlockWidth-1 {
+		buddy := a.find(width, offset^uint32(1)<<width)
+		if buddy < 0 {
+			break
+		}
+		a.free[width] = append(a.free[width][:buddy], a.free[width][buddy+1:]...)
+		offset &^= uint32(1) << width
+		width++
+	}
+	a.insert(width, offset)
+	return nil
+}
+
+// overlaps checks whether the block overlaps any free block: the free block which contains it
+// or the smaller free block inside it
+func (a *Allocator) overlaps(width, offset uint32) bool {
+	for w := uint32(minBlockWidth); w < maxBlockWidth; w++ {
+		if w >= width {
+			if a.find(w, offset&^(uint32(1)<<w-1)) >= 0 {
+				return true
+			}
+			continue
+		}
+		offsets := a.free[w]
+		i := sort.Search(len(offsets), func(i int) bool {
+			return offsets[i] >= offset
+		})
+		if i < len(offsets) && uint64(offsets[i]) < uint64(offset)+uint64(1)<<width {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns position of the free block or -1
+func (a *Allocator) find(width, offset uint32) int {
+	offsets := a.free[width]
+	i := sort.Search(len(offsets), func(i int) bool {
+		return offsets[i] >= offset
+	})
+	if i < len(offsets) && offsets[i] == offset {
+		return i
+	}
+	return -1
+}
+
+// insert adds the free block keeping offsets sorted
+func (a *Allocator) insert(width, offset uint32) {
+	offsets := a.free[width]
+	i := sort.Search(len(offsets), func(i int) bool {
+		return offsets[i] >= offset
+	})
+	offsets = append(offsets, 0)
+	copy(offsets[i+1:], offsets[i:])
+	offsets[i] = offset
+	a.free[width] = offsets
+}
+
+// MarshalBinary encodes free blocks as they are kept in the root block:
+// 32 lists of sorted offsets, each one with the count before
+func (a *Allocator) MarshalBinary() ([]byte, error) {
+	b := new(bytes.Buffer)
+	for _, offsets := range a.free {
+		if err := writeUint32(b, uint32(len(offsets))); err != nil {
+			return nil, err
+		}
+		if err := writeUint32(b, offsets...); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes free blocks of the root block. Data after free blocks is ignored
+func (a *Allocator) UnmarshalBinary(data []byte) error {
+	freeBlocks, err := readFreeBlocks(bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	return a.load(freeBlocks)
+}
+
+// load replaces free blocks with the given ones
+func (a *Allocator) load(freeBlocks [][]uint32) error {
+	var free [32][]uint32
+	for i, offsets := range freeBlocks {
+		for _, offset := range offsets {
+			if i < minBlockWidth || offset&(uint32(1)<<uint(i)-1) != 0 {
+				return ErrBadBlock
+			}
+		}
+		free[i] = append([]uint32{}, offsets...)
+		sort.Slice(free[i], func(j, k int) bool {
+			return free[i][j] < free[i][k]
+		})
+	}
+	a.free = free
+	return nil
+}
@@ -0,0 +1,166 @@
+package dsstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"unicode/utf16"
+)
+
+// CarvedRecord is the record recovered by Carve
+type CarvedRecord struct {
+	Record
+	Offset     int64   // byte offset of the record in the file
+	Confidence float64 // confidence of recovering from 0 to 1
+	Stale      bool    // record is not a part of the live B-tree: it is in free or unused space
+}
+
+// Maximal length of carved file names in UTF-16 units
+const carveMaxName = 1024
+
+// carver collects records found by Carve
+type carver struct {
+	data  []byte
+	live  map[int64]bool // positions of records of the live B-tree, nil when B-tree can't be read
+	found map[int64]CarvedRecord
+}
+
+// Carve scans data for plausible record encodings without B-tree structure.
+// It is a recovery tool for files with damaged header, root block or DSDB block.
+// Every 32-byte-aligned region is checked for B-tree node header and for records,
+// so records which are left in free blocks and unused parts of blocks are found too.
+// Records of the live B-tree are returned with Stale = false if the B-tree can be read.
+// The result is sorted by offset.
+func Carve(data []byte) []CarvedRecord {
+	c := &carver{data: data, found: make(map[int64]CarvedRecord)}
+	// records of the live B-tree
+	v := newValidator(data)
+	v.validate()
+	if v.records > 0 {
+		c.live = v.positions
+	}
+	// nodes can start at 32-byte-aligned regions. block data starts after 4 bytes of the file prefix
+	for region := 4; region < len(data); region += 32 {
+		c.carveNode(region)
+	}
+	// records which are not in nodes
+	for p := 4; p < len(data); {
+		if n := c.carveRecord(p, 0); n > 0 {
+			p += n
+			continue
+		}
+		p++
+	}
+	// sort by offset
+	records := make([]CarvedRecord, 0, len(c.found))
+	for _, r := range c.found {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Offset < records[j].Offset
+	})
+	return records
+}
+
+// carveNode parses records of B-tree node which can start at the position
+func (c *carver) carveNode(p int) {
+	if p+8 > len(c.data) {
+		return
+	}
+	next := binary.BigEndian.Uint32(c.data[p:])
+	count := binary.BigEndian.Uint32(c.data[p+4:])
+	// real nodes have few records and point to few blocks
+	if count == 0 || uint64(count)*13 > uint64(len(c.data)-p) || next > 0xffff {
+		return
+	}
+	p += 8
+	for i := 0; i < int(count); i++ {
+		if next > 0 {
+			if p+4 > len(c.data) || binary.BigEndian.Uint32(c.data[p:]) > 0xffff {
+				return
+			}
+			p += 4
+		}
+		n := c.carveRecord(p, 0.2)
+		if n == 0 {
+			return
+		}
+		p += n
+	}
+}
+
+// carveRecord checks the record at the position and returns its size or 0 if it is not plausible.
+// bonus is added to confidence of found record
+func (c *carver) carveRecord(p int, bonus float64) int {
+	data := c.data
+	// quick check of name length and type
+	if p+4 > len(data) {
+		return 0
+	}
+	nameLen := int(binary.BigEndian.Uint32(data[p:]))
+	if nameLen == 0 || nameLen > carveMaxName || p+4+2*nameLen+8 > len(data) {
+		return 0
+	}
+	typeAt := p + 4 + 2*nameLen + 4
+	if _, err := valueSize(string(data[typeAt : typeAt+4])); err != nil {
+		return 0
+	}
+	// name
+	units := make([]uint16, nameLen)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(data[p+4+2*i:])
+	}
+	if !carveName(units) {
+		return 0
+	}
+	// full record
+	b := bytes.NewBuffer(data[p:])
+	r, err := readParseFile(b)
+	if err != nil {
+		return 0
+	}
+	size := len(data) - p - b.Len()
+	if r.Type == TypeBool && r.Data[0] > 1 {
+		return 0
+	}
+	// confidence
+	confidence := 0.4 + bonus
+	if t, ok := codeTypes[r.Code()]; ok {
+		confidence += 0.2
+		if t == r.Type {
+			confidence += 0.1
+		}
+	}
+	stale := false
+	if c.live != nil {
+		stale = !c.live[int64(p)]
+		if !stale {
+			confidence += 0.1
+		}
+	}
+	if confidence > 1 {
+		confidence = 1
+	}
+	if prev, ok := c.found[int64(p)]; !ok || prev.Confidence < confidence {
+		c.found[int64(p)] = CarvedRecord{r, int64(p), confidence, stale}
+	}
+	return size
+}
+
+// carveName checks that UTF-16 name is valid and printable
+func carveName(units []uint16) bool {
+	for i := 0; i < len(units); i++ {
+		u := units[i]
+		switch {
+		case u < 0x20 || u == 0x7f || u == 0xfffe || u == 0xffff:
+			return false
+		case utf16.IsSurrogate(rune(u)):
+			// surrogates must be paired
+			if u >= 0xdc00 || i+1 >= len(units) || units[i+1] < 0xdc00 || units[i+1] > 0xdfff {
+				return false
+			}
+			i++
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package dsstore
+
+import "fmt"
+
+// Record property codes
+// https://metacpan.org/pod/distribution/Mac-Finder-DSStore/DSStoreFormat.pod#Records
+const (
+	CodeBKGD = FourCC('B'<<24 | 'K'<<16 | 'G'<<8 | 'D') // blob, 12 bytes: folder background (pre-10.5)
+	CodeGRP0 = FourCC('G'<<24 | 'R'<<16 | 'P'<<8 | '0') // ustr: unknown, group
+	CodeICVO = FourCC('I'<<24 | 'C'<<16 | 'V'<<8 | 'O') // blob: icon view options (pre-10.5)
+	CodeIloc = FourCC('I'<<24 | 'l'<<16 | 'o'<<8 | 'c') // blob, 16 bytes: icon location
+	CodeLSVO = FourCC('L'<<24 | 'S'<<16 | 'V'<<8 | 'O') // blob: list view options (pre-10.5)
+	CodeBwsp = FourCC('b'<<24 | 'w'<<16 | 's'<<8 | 'p') // blob: plist with browser window settings
+	CodeCmmt = FourCC('c'<<24 | 'm'<<16 | 'm'<<8 | 't') // ustr: Spotlight comments
+	CodeDilc = FourCC('d'<<24 | 'i'<<16 | 'l'<<8 | 'c') // blob, 32 bytes: icon location on desktop
+	CodeDscl = FourCC('d'<<24 | 's'<<16 | 'c'<<8 | 'l') // bool: disclosure state in list view
+	CodeExtn = FourCC('e'<<24 | 'x'<<16 | 't'<<8 | 'n') // ustr: file extension
+	CodeFwi0 = FourCC('f'<<24 | 'w'<<16 | 'i'<<8 | '0') // blob, 16 bytes: Finder window information
+	CodeFwsw = FourCC('f'<<24 | 'w'<<16 | 's'<<8 | 'w') // long: sidebar width
+	CodeFwvh = FourCC('f'<<24 | 'w'<<16 | 'v'<<8 | 'h') // shor: window height
+	CodeGlvp = FourCC('g'<<24 | 'l'<<16 | 'v'<<8 | 'p') // blob: plist with gallery view settings
+	CodeIcgo = FourCC('i'<<24 | 'c'<<16 | 'g'<<8 | 'o') // blob, 8 bytes: unknown, icon view
+	CodeIcsp = FourCC('i'<<24 | 'c'<<16 | 's'<<8 | 'p') // blob, 8 bytes: icon view scroll position
+	CodeIcvo = FourCC('i'<<24 | 'c'<<16 | 'v'<<8 | 'o') // blob: icon view options
+	CodeIcvp = FourCC('i'<<24 | 'c'<<16 | 'v'<<8 | 'p') // blob: plist with icon view settings
+	CodeIcvt = FourCC('i'<<24 | 'c'<<16 | 'v'<<8 | 't') // shor: icon view text size
+	CodeInfo = FourCC('i'<<24 | 'n'<<16 | 'f'<<8 | 'o') // blob: unknown, folder information
+	CodeLogS = FourCC('l'<<24 | 'o'<<16 | 'g'<<8 | 'S') // comp: logical size of the folder
+	CodeLg1S = FourCC('l'<<24 | 'g'<<16 | '1'<<8 | 'S') // comp: logical size of the folder
+	CodeLssp = FourCC('l'<<24 | 's'<<16 | 's'<<8 | 'p') // blob, 8 bytes: list view scroll position
+	CodeLsvC = FourCC('l'<<24 | 's'<<16 | 'v'<<8 | 'C') // blob: plist with list view columns
+	CodeLsvo = FourCC('l'<<24 | 's'<<16 | 'v'<<8 | 'o') // blob, 76 bytes: list view options
+	CodeLsvt = FourCC('l'<<24 | 's'<<16 | 'v'<<8 | 't') // shor: list view text size
+	CodeLsvp = FourCC('l'<<24 | 's'<<16 | 'v'<<8 | 'p') // blob: plist with list view settings
+	CodeLsvP = FourCC('l'<<24 | 's'<<16 | 'v'<<8 | 'P') // blob: plist with list view settings
+	CodeModD = FourCC('m'<<24 | 'o'<<16 | 'd'<<8 | 'D') // dutc: modification date
+	CodeMoDD = FourCC('m'<<24 | 'o'<<16 | 'D'<<8 | 'D') // dutc: modification date
+	CodePBBk = FourCC('p'<<24 | 'B'<<16 | 'B'<<8 | 'k') // blob: bookmark of the background picture
+	CodePhyS = FourCC('p'<<24 | 'h'<<16 | 'y'<<8 | 'S') // comp: physical size of the folder
+	CodePh1S = FourCC('p'<<24 | 'h'<<16 | '1'<<8 | 'S') // comp: physical size of the folder
+	CodePict = FourCC('p'<<24 | 'i'<<16 | 'c'<<8 | 't') // blob: alias of the background picture
+	CodePtbL = FourCC('p'<<24 | 't'<<16 | 'b'<<8 | 'L') // ustr: Trash put back location
+	CodePtbN = FourCC('p'<<24 | 't'<<16 | 'b'<<8 | 'N') // ustr: Trash put back name
+	CodeVSrn = FourCC('v'<<24 | 'S'<<16 | 'r'<<8 | 'n') // long: unknown, always 1
+	CodeVstl = FourCC('v'<<24 | 's'<<16 | 't'<<8 | 'l') // type: view style
+)
+
+// codeTypes are data types of known property codes
+var codeTypes = map[FourCC]string{
+	CodeBKGD: TypeBlob,
+	CodeGRP0: TypeString,
+	CodeICVO: TypeBlob,
+	CodeIloc: TypeBlob,
+	CodeLSVO: TypeBlob,
+	CodeBwsp: TypeBlob,
+	CodeCmmt: TypeString,
+	CodeDilc: TypeBlob,
+	CodeDscl: TypeBool,
+	CodeExtn: TypeString,
+	CodeFwi0: TypeBlob,
+	CodeFwsw: TypeLong,
+	CodeFwvh: TypeShort,
+	CodeGlvp: TypeBlob,
+	CodeIcgo: TypeBlob,
+	CodeIcsp: TypeBlob,
+	CodeIcvo: TypeBlob,
+	CodeIcvp: TypeBlob,
+	CodeIcvt: TypeShort,
+	CodeInfo: TypeBlob,
+	CodeLogS: TypeComp,
+	CodeLg1S: TypeComp,
+	CodeLssp: TypeBlob,
+	CodeLsvC: TypeBlob,
+	CodeLsvo: TypeBlob,
+	CodeLsvt: TypeShort,
+	CodeLsvp: TypeBlob,
+	CodeLsvP: TypeBlob,
+	CodeModD: TypeDate,
+	CodeMoDD: TypeDate,
+	CodePBBk: TypeBlob,
+	CodePhyS: TypeComp,
+	CodePh1S: TypeComp,
+	CodePict: TypeBlob,
+	CodePtbL: TypeString,
+	CodePtbN: TypeString,
+	CodeVSrn: TypeLong,
+	CodeVstl: TypeFourCC,
+}
+
+// ParseFourCC parses four-character code from 4 bytes string
+func ParseFourCC(s string) (FourCC, error) {
+	if len(s) != 4 {
+		return 0, fmt.Errorf("invalid four-character code [%s]", s)
+	}
+	return FourCC(s[0])<<24 | FourCC(s[1])<<16 | FourCC(s[2])<<8 | FourCC(s[3]), nil
+}
+
+// Code returns property code of the record
+func (r Record) Code() FourCC {
+	return FourCC(r.Extra)
+}
+
+// SetCode sets property code of the record
+func (r *Record) SetCode(code FourCC) {
+	r.Extra = uint32(code)
+}
@@ -0,0 +1,101 @@
+package dsstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// readUint32 reads big-endian uint32 directly from the buffer
+func readUint32(b *bytes.Buffer, v *uint32) error {
+	p := b.Next(4)
+	if len(p) < 4 {
+		if len(p) == 0 {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	}
+	*v = binary.BigEndian.Uint32(p)
+	return nil
+}
+
+// readUint32s reads big-endian uint32 values directly from the buffer
+func readUint32s(b *bytes.Buffer, values []uint32) error {
+	for i := range values {
+		if err := readUint32(b, &values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBytes returns the next n bytes of the buffer without copying
+func readBytes(b *bytes.Buffer, n int) ([]byte, error) {
+	p := b.Next(n)
+	if len(p) < n {
+		if len(p) == 0 && n > 0 {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	return p, nil
+}
+
+// writeUint32 writes big-endian uint32 values
+func writeUint32(b *bytes.Buffer, values ...uint32) error {
+	var p [4]byte
+	for _, v := range values {
+		binary.BigEndian.PutUint32(p[:], v)
+		if _, err := b.Write(p[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeUTF16 decodes UTF-16BE string. Invalid surrogates are replaced by U+FFFD
+func decodeUTF16(p []byte) string {
+	s := make([]byte, 0, len(p)/2)
+	for i := 0; i+1 < len(p); i += 2 {
+		r := rune(binary.BigEndian.Uint16(p[i:]))
+		if utf16.IsSurrogate(r) {
+			r2 := utf8.RuneError
+			if i+3 < len(p) {
+				r2 = rune(binary.BigEndian.Uint16(p[i+2:]))
+			}
+			if r = utf16.DecodeRune(r, r2); r != utf8.RuneError {
+				i += 2
+			}
+		}
+		s = utf8.AppendRune(s, r)
+	}
+	return string(s)
+}
+
+// lengthUTF16 returns length of string in UTF-16 code units
+func lengthUTF16(s string) int {
+	n := 0
+	for _, r := range s {
+		n++
+		if r >= 0x10000 {
+			n++
+		}
+	}
+	return n
+}
+
+// encodeUTF16 encodes string to UTF-16BE. Invalid UTF-8 bytes are encoded as U+FFFD
+func encodeUTF16(s string) []byte {
+	p := make([]byte, 0, 2*len(s))
+	for _, r := range s {
+		if r >= 0x10000 {
+			r1, r2 := utf16.EncodeRune(r)
+			p = append(p, byte(r1>>8), byte(r1), byte(r2>>8), byte(r2))
+			continue
+		}
+		p = append(p, byte(r>>8), byte(r))
+	}
+	return p
+}
@@ -0,0 +1,84 @@
+package dsstore
+
+import (
+	"sort"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// compareNames compares file names the way Finder orders them in B-tree:
+// case-insensitively by UTF-16 code units of case folded names
+func compareNames(a, b string) int {
+	ua, ub := foldName{s: a}, foldName{s: b}
+	for {
+		ra, oka := ua.next()
+		rb, okb := ub.next()
+		switch {
+		case !oka && !okb:
+			return 0
+		case !oka:
+			return -1
+		case !okb:
+			return 1
+		case ra < rb:
+			return -1
+		case ra > rb:
+			return 1
+		}
+	}
+}
+
+// foldName returns UTF-16 code units of case folded name without allocations
+type foldName struct {
+	s   string
+	low rune // pending low surrogate
+}
+
+func (f *foldName) next() (rune, bool) {
+	if f.low != 0 {
+		r := f.low
+		f.low = 0
+		return r, true
+	}
+	if len(f.s) == 0 {
+		return 0, false
+	}
+	r, size := utf8.DecodeRuneInString(f.s)
+	f.s = f.s[size:]
+	r = unicode.ToLower(r)
+	if r >= 0x10000 {
+		r, f.low = utf16.EncodeRune(r)
+	}
+	return r, true
+}
+
+// compareKeys compares B-tree keys: file name and then property code
+func compareKeys(fileName1 string, code1 FourCC, fileName2 string, code2 FourCC) int {
+	if c := compareNames(fileName1, fileName2); c != 0 {
+		return c
+	}
+	switch {
+	case code1 < code2:
+		return -1
+	case code1 > code2:
+		return 1
+	}
+	return 0
+}
+
+// CompareRecords compares records the way Finder orders them in B-tree:
+// by case-insensitive file name and then by property code.
+// It returns -1, 0 or 1
+func CompareRecords(a, b Record) int {
+	return compareKeys(a.FileName, a.Code(), b.FileName, b.Code())
+}
+
+// sortRecords returns records sorted in Finder order
+func sortRecords(records []Record) []Record {
+	sorted := append([]Record{}, records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return CompareRecords(sorted[i], sorted[j]) < 0
+	})
+	return sorted
+}
@@ -3,23 +3,84 @@ package dsstore
 // Record in .DS_Store
 type Record struct {
 	FileName string // file name
-	Extra    uint32 // extra (unknown data)
+	Extra    uint32 // property code (see Code)
 	Type     string // type
 	DataLen  uint32 // explicit data size in bytes
 	Data     []byte // raw data
 }
 
+// Topic is the entry of root block topic table
+type Topic struct {
+	Name   string            // topic name
+	Index  uint32            // index of the topic block
+	Blocks map[uint32][]byte // raw data of blocks behind unknown topic by block index (nil for DSDB)
+}
+
 // Store of .DS_Store file
 type Store struct {
 	HeaderExtra []byte   // header extra data (unknown)
 	RootExtra   []byte   // root (bookkeeping) extra data (unknown)
 	DSDBExtra   []byte   // DSDB extra data (unknown)
 	Records     []Record // records
+	Topics      []Topic  // topics of root block. DSDB topic is written from Records
+	Warnings    []error  // errors skipped in lenient reading mode (see ReadOptions)
+
+	// PreserveLayout makes Write keep the block layout of the file which was read:
+	// block offsets, free blocks and unused bytes of blocks.
+	// Unmodified store is written byte to byte as it was read.
+	// When records don't fit the original B-tree nodes the store is written with new layout.
+	PreserveLayout bool
+
+	layout *layout // block layout of the file which was read
+}
+
+// Find returns the record with the file name and the property code.
+// File names are compared case-insensitively the way Finder does
+func (s *Store) Find(fileName string, code FourCC) (Record, bool) {
+	if i := s.find(fileName, code); i >= 0 {
+		return s.Records[i], true
+	}
+	return Record{}, false
+}
+
+// Set replaces the record with the same file name and property code or adds the new one.
+// The new record is inserted before the first greater record, so sorted records stay sorted
+func (s *Store) Set(r Record) {
+	if i := s.find(r.FileName, r.Code()); i >= 0 {
+		s.Records[i] = r
+		return
+	}
+	i := len(s.Records)
+	for j := range s.Records {
+		if CompareRecords(s.Records[j], r) > 0 {
+			i = j
+			break
+		}
+	}
+	s.Records = append(s.Records, Record{})
+	copy(s.Records[i+1:], s.Records[i:])
+	s.Records[i] = r
+}
+
+// find returns index of the record or -1
+func (s *Store) find(fileName string, code FourCC) int {
+	for i, r := range s.Records {
+		if compareKeys(r.FileName, r.Code(), fileName, code) == 0 {
+			return i
+		}
+	}
+	return -1
 }
 
 const headerMagic1 uint32 = 0x1
 const headerMagic2 uint32 = 0x42756431
 
+// B-tree node page size. Finder stores it in DSDB block and always uses 0x1000
+const nodePageSize uint32 = 0x1000
+
+// Maximal depth of B-tree. Real files have 1-3 levels, the limit protects against crafted files
+const maxTreeDepth = 32
+
 func blockSize(offset uint32) uint32 {
 	return uint32(1) << (offset & uint32(0x1f))
 }
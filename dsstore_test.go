@@ -2,9 +2,20 @@ package dsstore
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gwend/dsstore/plist"
 )
 
 func TestRead(t *testing.T) {
@@ -142,3 +153,1491 @@ func TestMassive(t *testing.T) {
 		testMassiveFile(t, filepath.Join(testdata, f.Name()))
 	}
 }
+
+func TestWriteLarge(t *testing.T) {
+	var s1, s2 Store
+	for i := 0; i < 2000; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 100)
+		s1.Records = append(s1.Records, Record{
+			FileName: fmt.Sprintf("file%05d.txt", i),
+			Extra:    0x626c6f62,
+			Type:     "blob",
+			DataLen:  uint32(len(data)),
+			Data:     data,
+		})
+	}
+	bufferWrite := new(bytes.Buffer)
+	err := s1.Write(bufferWrite)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	err = s2.Read(bytes.NewBuffer(bufferWrite.Bytes()))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(s1.Records) != len(s2.Records) {
+		t.Errorf("Records count is different: %d != %d", len(s1.Records), len(s2.Records))
+		return
+	}
+	for i := 0; i < len(s1.Records); i++ {
+		if s1.Records[i].FileName != s2.Records[i].FileName || !bytes.Equal(s1.Records[i].Data, s2.Records[i].Data) {
+			t.Errorf("Record %d is different", i)
+		}
+	}
+}
+
+// oversizedNodes returns count of B-tree nodes which exceed the page and count of levels of the store which was read
+func oversizedNodes(s *Store) (int, uint32) {
+	count := 0
+	nodes := []*layoutNode{s.layout.tree}
+	for i := 0; i < len(nodes); i++ {
+		if nodes[i].size > int(nodePageSize) {
+			count++
+		}
+		nodes = append(nodes, nodes[i].children...)
+	}
+	return count, s.layout.levels
+}
+
+func TestWriteLargeRecords(t *testing.T) {
+	tests := []struct {
+		small, large int // count of small and large records
+		size         int // data size of large records
+		oversized    int // expected maximum of oversized nodes
+	}{
+		// large records at the end need items of previous pages
+		{300, 5, 3000, 0},
+		{300, 7, 3000, 0},
+		{0, 31, 1800, 0},
+		// no two records fit the page, the last page of every level with even items has two
+		{0, 30, 3000, 5},
+		{0, 300, 5000, 300},
+	}
+	for _, test := range tests {
+		var s1, s2 Store
+		for i := 0; i < test.small; i++ {
+			s1.Records = append(s1.Records, NewBlobRecord(fmt.Sprintf("file%03d", i), CodeIloc, make([]byte, 200)))
+		}
+		for i := 0; i < test.large; i++ {
+			s1.Records = append(s1.Records, NewBlobRecord(fmt.Sprintf("large%03d", i), CodeIloc, make([]byte, test.size)))
+		}
+		bufferWrite := new(bytes.Buffer)
+		if err := s1.Write(bufferWrite); err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		if len(s2.Records) != len(s1.Records) {
+			t.Errorf("Records count is different: %d != %d", len(s2.Records), len(s1.Records))
+			return
+		}
+		oversized, levels := oversizedNodes(&s2)
+		if oversized > test.oversized {
+			t.Errorf("%d records of %d bytes: %d nodes exceed the page", test.large, test.size, oversized)
+		}
+		// every node has at least one record, so the tree is not deeper than the binary tree
+		if max := math.Ceil(math.Log2(float64(len(s1.Records) + 1))); float64(levels+1) > max {
+			t.Errorf("%d records of %d bytes: %d levels", test.large, test.size, levels)
+		}
+		if findings := Validate(bufferWrite.Bytes()); len(findings) > 0 {
+			t.Errorf("Unexpected findings: %v", findings)
+		}
+	}
+}
+
+func TestValue(t *testing.T) {
+	date := time.Date(2020, time.September, 25, 10, 30, 15, 500000000, time.UTC)
+	values := []interface{}{true, int32(-5), int16(-3), FourCC(0x69636e76), uint64(1) << 40, date, "Приложение 😀.app", []byte{1, 2, 3}}
+	var s1, s2 Store
+	for i, v := range values {
+		var r Record
+		if err := r.SetValue(v); err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		r.FileName = fmt.Sprintf("file%d", i)
+		s1.Records = append(s1.Records, r)
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	for i, r := range s2.Records {
+		v, err := r.Value()
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(v, values[i]) {
+			t.Errorf("Value %d is different: %v != %v", i, v, values[i])
+		}
+	}
+	// inconsistent record
+	s1.Records = []Record{{FileName: "file", Type: TypeLong, Data: []byte{1}}}
+	if err := s1.Write(new(bytes.Buffer)); err == nil {
+		t.Errorf("Inconsistent record is written")
+	}
+	// dates out of dutc range and far dates
+	for _, v := range []time.Time{time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(1903, time.December, 31, 23, 59, 59, 0, time.UTC)} {
+		var r Record
+		if err := r.SetValue(v); err == nil {
+			t.Errorf("Date %s is accepted", v)
+		}
+		if _, err := NewDateRecord("file", CodeModD, v); err == nil {
+			t.Errorf("Date record %s is created", v)
+		}
+	}
+	for _, v := range []time.Time{macEpoch, time.Date(2300, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)} {
+		r, err := NewDateRecord("file", CodeModD, v)
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		value, err := r.Value()
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		if value != v {
+			t.Errorf("Date is different: %v != %v", value, v)
+		}
+	}
+}
+
+func TestFourCC(t *testing.T) {
+	code, err := ParseFourCC("Iloc")
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if code != CodeIloc || uint32(code) != 0x496c6f63 || code.String() != "Iloc" {
+		t.Errorf("Invalid code %08x", uint32(code))
+	}
+	if _, err := ParseFourCC("Ilo"); err == nil {
+		t.Errorf("Invalid code is parsed")
+	}
+	var s Store
+	if err := s.ReadFile(filepath.Join(".", "testdata", "00.DS_Store")); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if s.Records[0].Code() != CodeBwsp {
+		t.Errorf("Invalid code %s", s.Records[0].Code())
+	}
+}
+
+func TestWriteEmptyValues(t *testing.T) {
+	var s1, s2 Store
+	s1.Records = []Record{
+		NewStringRecord("a", CodeCmmt, ""),
+		NewBlobRecord("b", CodePict, nil),
+		NewStringRecord("c", CodeCmmt, ""),
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(s2.Records) != len(s1.Records) {
+		t.Errorf("Records count is different: %d != %d", len(s1.Records), len(s2.Records))
+		return
+	}
+	for i, r := range s2.Records {
+		if r.Type != s1.Records[i].Type || r.DataLen != 0 || len(r.Data) != 0 {
+			t.Errorf("Record %d is different", i)
+		}
+	}
+}
+
+func TestWritePreserveLayout(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(".", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	var s Store
+	if err = s.Read(bytes.NewBuffer(data)); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	s.PreserveLayout = true
+	bufferWrite := new(bytes.Buffer)
+	if err = s.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !bytes.Equal(data, bufferWrite.Bytes()) {
+		t.Errorf("Unmodified store is written with different bytes")
+	}
+	// modified record keeps the layout
+	s.Records[0].FileName = "/"
+	bufferWrite.Reset()
+	if err = s.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(data) != bufferWrite.Len() {
+		t.Errorf("Layout is changed")
+	}
+	// shorter extra data doesn't leave stale bytes
+	marker := []byte("stale")
+	rootExtra, dsdbExtra := s.RootExtra, s.DSDBExtra
+	s.RootExtra = bytes.Repeat(marker, len(rootExtra)/len(marker))
+	s.DSDBExtra = bytes.Repeat(marker, len(dsdbExtra)/len(marker))
+	bufferWrite.Reset()
+	if err = s.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(data) != bufferWrite.Len() || bytes.Count(bufferWrite.Bytes(), marker) != len(rootExtra)/len(marker)+len(dsdbExtra)/len(marker) {
+		t.Errorf("Extra data is not written with preserved layout")
+		return
+	}
+	var s3 Store
+	if err = s3.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	s3.PreserveLayout = true
+	s3.RootExtra, s3.DSDBExtra = nil, nil
+	bufferWrite.Reset()
+	if err = s3.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(data) != bufferWrite.Len() || bytes.Contains(bufferWrite.Bytes(), marker) {
+		t.Errorf("Stale extra data is left")
+		return
+	}
+	s.RootExtra, s.DSDBExtra = rootExtra, dsdbExtra
+	// new records don't fit the layout
+	for i := 0; i < 100; i++ {
+		s.Records = append(s.Records, NewBlobRecord(fmt.Sprintf("file%03d", i), CodeIloc, make([]byte, 16)))
+	}
+	bufferWrite.Reset()
+	if err = s.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	var s2 Store
+	if err = s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(s2.Records) != len(s.Records) {
+		t.Errorf("Records count is different: %d != %d", len(s.Records), len(s2.Records))
+	}
+}
+
+func TestOpen(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(".", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	var s Store
+	if err = s.Read(bytes.NewBuffer(data)); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	f, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if f.Len() != len(s.Records) {
+		t.Errorf("Records count is different: %d != %d", f.Len(), len(s.Records))
+	}
+	i := 0
+	err = f.Each(func(r Record) error {
+		if !reflect.DeepEqual(r, s.Records[i]) {
+			t.Errorf("Record %d is different", i)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+}
+
+type countingReaderAt struct {
+	r     io.ReaderAt
+	count int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.count++
+	return c.r.ReadAt(p, off)
+}
+
+func TestFind(t *testing.T) {
+	var s Store
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("file%05d.txt", i)
+		s.Records = append(s.Records, NewBlobRecord(name, CodeIloc, make([]byte, 16)))
+		s.Records = append(s.Records, NewStringRecord(name, CodeCmmt, name))
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	reader := &countingReaderAt{r: bytes.NewReader(bufferWrite.Bytes())}
+	f, err := Open(reader, int64(bufferWrite.Len()))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	for _, i := range []int{0, 1, 500, 998, 1999} {
+		want := s.Records[i]
+		reader.count = 0
+		r, ok, err := f.Find(strings.ToUpper(want.FileName), want.Code())
+		if err != nil || !ok || !reflect.DeepEqual(r, want) {
+			t.Errorf("Record %s %s is not found", want.FileName, want.Code())
+		}
+		if reader.count > int(f.tree.levels)+1 {
+			t.Errorf("Too many blocks are read: %d", reader.count)
+		}
+	}
+	if _, ok, _ := f.Find("file00500.txt", CodeBwsp); ok {
+		t.Errorf("Missing record is found")
+	}
+	if _, ok, _ := f.Find("missing", CodeIloc); ok {
+		t.Errorf("Missing record is found")
+	}
+	for _, i := range []int{0, 250, 999} {
+		records, err := f.FindAll(fmt.Sprintf("file%05d.txt", i))
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			continue
+		}
+		if len(records) != 2 || records[0].Code() != CodeIloc || records[1].Code() != CodeCmmt {
+			t.Errorf("Records of file %d are not found", i)
+		}
+	}
+}
+
+func TestWriteOrder(t *testing.T) {
+	var s1, s2 Store
+	s1.Records = []Record{
+		NewStringRecord("b", CodeCmmt, "3"),
+		NewBlobRecord("B", CodeIloc, make([]byte, 16)),
+		NewStringRecord("a", CodeCmmt, "1"),
+		NewStringRecord("Ä", CodeCmmt, "5"),
+		NewStringRecord("A", CodeExtn, "2"),
+		NewStringRecord("ä", CodeExtn, "6"),
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	order := []string{"a", "A", "B", "b", "Ä", "ä"}
+	for i, r := range s2.Records {
+		if r.FileName != order[i] {
+			t.Errorf("Record %d is %s, want %s", i, r.FileName, order[i])
+		}
+		if i > 0 && CompareRecords(s2.Records[i-1], r) >= 0 {
+			t.Errorf("Records %d and %d are not sorted", i-1, i)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(".", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	tests := []struct {
+		offset int
+		patch  []byte
+		target error
+		stage  string
+		index  int
+		at     int64
+	}{
+		{4, []byte("Bud2"), ErrBadMagic, StageHeader, -1, 4},
+		{0x1016, []byte("xxxx"), ErrUnknownType, StageRecord, 2, 0x100c},
+		{0x100c, []byte{0, 0, 0x10, 0}, ErrTruncated, StageRecord, 2, 0x100c},
+		{0x2014, []byte{0, 1, 0, 0x0c}, ErrBadBlock, StageNode, 2, 0x10004},
+	}
+	for _, test := range tests {
+		corrupted := append([]byte{}, data...)
+		copy(corrupted[test.offset:], test.patch)
+		var s Store
+		err := s.Read(bytes.NewBuffer(corrupted))
+		if !errors.Is(err, test.target) {
+			t.Errorf("Invalid error: %v", err)
+			continue
+		}
+		var pe *ParseError
+		if !errors.As(err, &pe) || pe.Stage != test.stage || pe.BlockIndex != test.index || pe.Offset != test.at {
+			t.Errorf("Invalid parse error: %v", err)
+		}
+	}
+}
+
+func TestReadMalicious(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(".", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	tests := []struct {
+		offset int
+		patch  []byte
+		target error
+	}{
+		// node references itself
+		{0x1004, []byte{0, 0, 0, 2, 0, 0, 0, 0}, ErrCycle},
+		// huge name and data sizes
+		{0x100c, []byte{0x7f, 0xff, 0xff, 0xff}, ErrTruncated},
+		{0x101a, []byte{0xff, 0xff, 0xff, 0xff}, ErrTruncated},
+		// block size overflows 32 bits
+		{0x2014, []byte{0xff, 0xff, 0xff, 0xff}, ErrBadBlock},
+		// huge offsets count
+		{0x2004, []byte{0xff, 0xff, 0xff, 0xff}, ErrTruncated},
+	}
+	for _, test := range tests {
+		corrupted := append([]byte{}, data...)
+		copy(corrupted[test.offset:], test.patch)
+		var s Store
+		if err := s.Read(bytes.NewBuffer(corrupted)); !errors.Is(err, test.target) {
+			t.Errorf("Invalid error: %v", err)
+		}
+		f, err := Open(bytes.NewReader(corrupted), int64(len(corrupted)))
+		if err == nil {
+			err = f.Each(func(r Record) error { return nil })
+		}
+		if !errors.Is(err, test.target) {
+			t.Errorf("Invalid error: %v", err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(".", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if findings := Validate(data); len(findings) > 0 {
+		t.Errorf("Unexpected findings: %v", findings)
+	}
+	// offsets table with extra block in free space
+	extraBlock := []byte{0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0x20, 0x0b, 0, 0, 0, 0x45, 0, 0, 0x10, 0x0c, 0, 0, 0, 0x65}
+	tests := []struct {
+		offset  int
+		patch   []byte
+		message string
+	}{
+		{0x10, []byte{0, 0, 0x10, 0}, "header root offsets are different"},
+		{0x4c, []byte{0, 0, 0, 7}, "DSDB records count 7 doesn't match B-tree records count 6"},
+		{0x1010, []byte{0, 'z'}, "is not sorted after"},
+		{0x2004, extraBlock, "block is unreachable"},
+		{0x2004, extraBlock, "free block overlaps used block"},
+		{0x2014, []byte{0, 0, 0x20, 0x0c}, "block overlaps block 0"},
+		{0x2020, []byte{0, 0, 0x30, 0x05}, "offset is out of offsets count"},
+	}
+	for _, test := range tests {
+		corrupted := append([]byte{}, data...)
+		copy(corrupted[test.offset:], test.patch)
+		found := false
+		for _, f := range Validate(corrupted) {
+			if strings.Contains(f.Message, test.message) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Finding %q is not found in %v", test.message, Validate(corrupted))
+		}
+	}
+	// nodes of extra topic B-tree are reachable
+	var s1 Store
+	s1.Records = []Record{NewBlobRecord("file", CodeIloc, make([]byte, 16))}
+	rootNode := new(bytes.Buffer)
+	if err := writeUint32(rootNode, 12, 1, 13); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s1.writeRecord(rootNode, NewBoolRecord("extra", CodeDscl, true)); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	s1.Topics = []Topic{{Name: "DSDB"}, {Name: "XTRA", Index: 10, Blocks: map[uint32][]byte{
+		10: {0, 0, 0, 11, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 3, 0, 0, 0x10, 0},
+		11: rootNode.Bytes(),
+		12: make([]byte, 8),
+		13: make([]byte, 8),
+	}}}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if findings := Validate(bufferWrite.Bytes()); len(findings) > 0 {
+		t.Errorf("Unexpected findings with extra topic: %v", findings)
+	}
+}
+
+func TestReadLenient(t *testing.T) {
+	var s1 Store
+	for i := 0; i < 2000; i++ {
+		s1.Records = append(s1.Records, NewBlobRecord(fmt.Sprintf("file%05d.txt", i), CodeIloc, make([]byte, 100)))
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	data := bufferWrite.Bytes()
+	f, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	// damage the first record of the leaf and the whole next leaf
+	leaf := 4 + int(blockOffset(f.offsets[5]))
+	copy(data[leaf+8:], []byte{0x7f, 0xff, 0xff, 0xff})
+	leaf = 4 + int(blockOffset(f.offsets[6]))
+	copy(data[leaf:], []byte{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	var s2 Store
+	if err := s2.Read(bytes.NewBuffer(data)); err == nil {
+		t.Errorf("Damaged file is read")
+	}
+	if err := s2.ReadWithOptions(bytes.NewBuffer(data), ReadOptions{Lenient: true}); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(s2.Warnings) != 2 {
+		t.Errorf("Invalid warnings: %v", s2.Warnings)
+	}
+	if len(s2.Records) < 1800 || len(s2.Records) >= 2000 {
+		t.Errorf("Invalid count of recovered records: %d", len(s2.Records))
+	}
+	for i := 1; i < len(s2.Records); i++ {
+		if CompareRecords(s2.Records[i-1], s2.Records[i]) >= 0 {
+			t.Errorf("Records %d and %d are not sorted", i-1, i)
+		}
+	}
+}
+
+func TestCarve(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(".", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	var s Store
+	if err = s.Read(bytes.NewBuffer(data)); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	// damaged header
+	corrupted := append([]byte{}, data...)
+	copy(corrupted, make([]byte, 36))
+	carved := Carve(corrupted)
+	if len(carved) != len(s.Records) {
+		t.Errorf("Invalid count of carved records: %d", len(carved))
+		return
+	}
+	for i, r := range carved {
+		if !reflect.DeepEqual(r.Record, s.Records[i]) || r.Confidence < 0.5 {
+			t.Errorf("Carved record %d is different", i)
+		}
+	}
+	// stale node in free space
+	s.Records = []Record{NewBlobRecord("new.txt", CodeIloc, make([]byte, 16))}
+	bufferWrite := new(bytes.Buffer)
+	if err = s.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	node := new(bytes.Buffer)
+	if err = s.writeBlockNode(node, &writeTreeNode{items: [][]byte{encodeTestRecord(NewBlobRecord("deleted.txt", CodeIloc, make([]byte, 16)))}}); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	data = append(bufferWrite.Bytes(), node.Bytes()...)
+	carved = Carve(data)
+	if len(carved) != 2 || carved[0].FileName != "new.txt" || carved[0].Stale || carved[1].FileName != "deleted.txt" || !carved[1].Stale {
+		t.Errorf("Invalid carved records: %v", carved)
+	}
+}
+
+func encodeTestRecord(r Record) []byte {
+	var s Store
+	b := new(bytes.Buffer)
+	if err := s.writeRecord(b, r); err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+func TestTopics(t *testing.T) {
+	var s1, s2 Store
+	raw := bytes.Repeat([]byte{0xab}, 32)
+	s1.Records = []Record{NewBlobRecord("file", CodeIloc, make([]byte, 16))}
+	s1.Topics = []Topic{{Name: "DSDB"}, {Name: "TEST", Index: 2, Blocks: map[uint32][]byte{2: raw}}}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(s2.Records) != 1 || len(s2.Topics) != 2 {
+		t.Errorf("Invalid records %d or topics %d", len(s2.Records), len(s2.Topics))
+		return
+	}
+	if s2.Topics[0].Name != "DSDB" || s2.Topics[1].Name != "TEST" || s2.Topics[1].Index != 2 || !bytes.Equal(s2.Topics[1].Blocks[2], raw) {
+		t.Errorf("Invalid topics %v", s2.Topics)
+	}
+	// topic without blocks keeps its index, B-tree nodes don't take it
+	s1.Topics = []Topic{{Name: "DSDB"}, {Name: "XTRA", Index: 3}}
+	for i := 0; i < 100; i++ {
+		s1.Records = append(s1.Records, NewBlobRecord(fmt.Sprintf("file%03d", i), CodeIloc, make([]byte, 100)))
+	}
+	bufferWrite.Reset()
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(s2.Records) != len(s1.Records) || len(s2.Topics) != 2 || s2.Topics[1].Index != 3 || len(s2.Topics[1].Blocks) != 0 {
+		t.Errorf("Invalid records %d or topics %v", len(s2.Records), s2.Topics)
+		return
+	}
+	// topics of the file without extra topics
+	if err := s2.ReadFile(filepath.Join(".", "testdata", "00.DS_Store")); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(s2.Topics) != 1 || s2.Topics[0].Name != "DSDB" || s2.Topics[0].Index != 1 {
+		t.Errorf("Invalid topics %v", s2.Topics)
+		return
+	}
+	// new topic doesn't fit the layout which was read
+	s2.PreserveLayout = true
+	s2.Topics = append(s2.Topics, Topic{Name: "TEST", Index: 2, Blocks: map[uint32][]byte{2: raw}})
+	bufferWrite.Reset()
+	if err := s2.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s1.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(s1.Topics) != 2 || s1.Topics[1].Name != "TEST" || !bytes.Equal(s1.Topics[1].Blocks[2], raw) {
+		t.Errorf("Topic is lost with preserved layout: %v", s1.Topics)
+		return
+	}
+	// changed block of the topic too
+	s1.PreserveLayout = true
+	s1.Topics[1].Blocks[2] = bytes.Repeat([]byte{0xcd}, 32)
+	bufferWrite.Reset()
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(s2.Topics) != 2 || !bytes.Equal(s2.Topics[1].Blocks[2], s1.Topics[1].Blocks[2]) {
+		t.Errorf("Topic block change is lost with preserved layout: %v", s2.Topics)
+	}
+}
+
+func TestWriteOffsets(t *testing.T) {
+	var s1, s2 Store
+	// more than 256 nodes
+	for i := 0; i < 1500; i++ {
+		s1.Records = append(s1.Records, NewBlobRecord(fmt.Sprintf("file%05d.txt", i), CodeIloc, bytes.Repeat([]byte{byte(i)}, 1000)))
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	f, err := Open(bytes.NewReader(bufferWrite.Bytes()), int64(bufferWrite.Len()))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(f.offsets) <= 256 || f.Len() != len(s1.Records) {
+		t.Errorf("Invalid offsets count %d or records count %d", len(f.offsets), f.Len())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(s1.Records, s2.Records) {
+		t.Errorf("Records are different")
+		return
+	}
+	// empty entries keep positions of the following blocks
+	raw := bytes.Repeat([]byte{0xcd}, 32)
+	s1.Records = s1.Records[:1]
+	s1.Topics = []Topic{{Name: "DSDB"}, {Name: "TEST", Index: 5, Blocks: map[uint32][]byte{5: raw}}}
+	bufferWrite.Reset()
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(s2.Records) != 1 || len(s2.Topics) != 2 || !bytes.Equal(s2.Topics[1].Blocks[5], raw) {
+		t.Errorf("Invalid topics %v", s2.Topics)
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	a := NewAllocator()
+	empty, err := a.MarshalBinary()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	// allocation splits bigger blocks
+	values := make([]uint32, 0)
+	for _, size := range []uint32{4096, 20, 32, 33, 2048} {
+		value, err := a.Alloc(size)
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		values = append(values, value)
+	}
+	expected := []uint32{0x100c, 0x25, 0x45, 0x86, 0x80b}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Invalid blocks %x != %x", values, expected)
+		return
+	}
+	if err := a.Free(values[1]); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := a.Free(values[1]); err == nil {
+		t.Errorf("Double free is accepted")
+		return
+	}
+	if err := a.Free(0x26); err == nil {
+		t.Errorf("Unaligned block is accepted")
+		return
+	}
+	if err := a.Free(0x06); err == nil {
+		t.Errorf("Block with free block inside is accepted")
+		return
+	}
+	// buddies are merged back to the empty heap
+	for _, value := range values[2:] {
+		if err := a.Free(value); err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+	}
+	if err := a.Free(values[0]); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	data, err := a.MarshalBinary()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !bytes.Equal(data, empty) {
+		t.Errorf("Free blocks are not merged: %v", a.FreeBlocks())
+		return
+	}
+	// sub-block of the merged buddy is already free
+	for _, value := range values {
+		if err := a.Free(value); err == nil {
+			t.Errorf("Sub-block %x of free block is accepted", value)
+			return
+		}
+	}
+	// free blocks of the file
+	fileData, err := ioutil.ReadFile(filepath.Join(".", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	f, err := Open(bytes.NewReader(fileData), int64(len(fileData)))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	a, err = f.Allocator()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	var b Allocator
+	data, err = a.MarshalBinary()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := b.UnmarshalBinary(data); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(a.FreeBlocks(), b.FreeBlocks()) || len(a.FreeBlocks()[11]) != 2 {
+		t.Errorf("Invalid free blocks %v", b.FreeBlocks())
+		return
+	}
+	// written files have valid free blocks
+	var s Store
+	if err := s.ReadFile(filepath.Join(".", "testdata", "00.DS_Store")); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	for i := 0; i < 300; i++ {
+		s.Records = append(s.Records, NewBlobRecord(fmt.Sprintf("file%03d", i), CodeIloc, make([]byte, 16)))
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if findings := Validate(bufferWrite.Bytes()); len(findings) > 0 {
+		t.Errorf("Unexpected findings: %v", findings)
+	}
+}
+
+// memFile is in-memory file for editing
+type memFile struct {
+	data []byte
+}
+
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[off:], p), nil
+}
+
+func TestEditor(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(".", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	var s1 Store
+	if err := s1.Read(bytes.NewBuffer(data)); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	// root block which is not in offsets table is rejected before any write
+	broken := append([]byte{}, data...)
+	copy(broken[0x200c:], []byte{0, 0, 0, 0})
+	if _, err := NewEditor(&memFile{data: broken}, int64(len(broken))); !errors.Is(err, ErrBadBlock) {
+		t.Errorf("Unexpected error %v", err)
+		return
+	}
+	m := &memFile{data: append([]byte{}, data...)}
+	e, err := NewEditor(m, int64(len(m.data)))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	// check the file and its records after every step
+	expected := make(map[string]Record)
+	for _, r := range s1.Records {
+		expected[r.FileName+r.Code().String()] = r
+	}
+	check := func(step string) bool {
+		if findings := Validate(m.data); len(findings) > 0 {
+			t.Errorf("%s: unexpected findings: %v", step, findings)
+			return false
+		}
+		var s2 Store
+		if err := s2.Read(bytes.NewBuffer(m.data)); err != nil {
+			t.Errorf("%s: %s", step, err.Error())
+			return false
+		}
+		if len(s2.Records) != len(expected) || e.Len() != len(expected) {
+			t.Errorf("%s: invalid records count %d, %d != %d", step, len(s2.Records), e.Len(), len(expected))
+			return false
+		}
+		for _, r := range s2.Records {
+			if !reflect.DeepEqual(r, expected[r.FileName+r.Code().String()]) {
+				t.Errorf("%s: record %s %s is different", step, r.FileName, r.Code())
+				return false
+			}
+		}
+		if !bytes.Equal(s1.DSDBExtra, s2.DSDBExtra) || !bytes.Equal(s1.RootExtra, s2.RootExtra) {
+			t.Errorf("%s: extra data is different", step)
+			return false
+		}
+		return true
+	}
+	// update one record
+	r := NewBlobRecord("Applications", CodeIloc, []byte{0, 0, 1, 0, 0, 0, 0, 0x80, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0})
+	if err := e.Update(r); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	expected["ApplicationsIloc"] = r
+	if !check("update") {
+		return
+	}
+	if err := e.Insert(r); !errors.Is(err, ErrRecordExists) {
+		t.Errorf("Insert of existing record: %v", err)
+		return
+	}
+	if err := e.Update(NewBoolRecord("missing", CodeDscl, true)); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Update of missing record: %v", err)
+		return
+	}
+	// insert records which split nodes
+	for i := 0; i < 300; i++ {
+		r := NewBlobRecord(fmt.Sprintf("file%03d", (i*7)%300), CodeIloc, bytes.Repeat([]byte{byte(i)}, 100))
+		if err := e.Insert(r); err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		expected[r.FileName+r.Code().String()] = r
+	}
+	if !check("insert") {
+		return
+	}
+	// delete records which merge nodes
+	for i := 0; i < 300; i++ {
+		fileName := fmt.Sprintf("file%03d", (i*11)%300)
+		if err := e.Delete(fileName, CodeIloc); err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		delete(expected, fileName+"Iloc")
+	}
+	if err := e.Delete("file000", CodeIloc); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Delete of missing record: %v", err)
+		return
+	}
+	if !check("delete") {
+		return
+	}
+	if r, ok, err := e.Find("applications", CodeIloc); err != nil || !ok || !bytes.Equal(r.Data, expected["ApplicationsIloc"].Data) {
+		t.Errorf("Record is not found: %v", err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(".", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	var s Store
+	if err := s.Read(bytes.NewBuffer(data)); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	// plain reader and reader with random access
+	for _, r := range []io.Reader{bytes.NewBuffer(data), bytes.NewReader(data)} {
+		records := make([]Record, 0)
+		err := Walk(r, func(r Record) error {
+			records = append(records, r)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		if !reflect.DeepEqual(records, s.Records) {
+			t.Errorf("Records are different")
+			return
+		}
+	}
+	// early stop
+	count := 0
+	err = Walk(bytes.NewBuffer(data), func(r Record) error {
+		count++
+		if count == 2 {
+			return ErrStop
+		}
+		return nil
+	})
+	if err != nil || count != 2 {
+		t.Errorf("Walk is not stopped: %v, %d", err, count)
+	}
+	// file and seeker are read on demand, Read is not called
+	file, err := ioutil.TempFile("", "dsstore")
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	for _, r := range []io.Reader{file, seekReaderAt{file}} {
+		records := make([]Record, 0)
+		err := Walk(r, func(r Record) error {
+			records = append(records, r)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		if !reflect.DeepEqual(records, s.Records) {
+			t.Errorf("Records are different")
+			return
+		}
+	}
+}
+
+// seekReaderAt is the reader with random access and without size, Read is not supported
+type seekReaderAt struct {
+	f *os.File
+}
+
+func (r seekReaderAt) Read(p []byte) (int, error) {
+	return 0, errors.New("read is not expected")
+}
+
+func (r seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.f.ReadAt(p, off)
+}
+
+func (r seekReaderAt) Seek(offset int64, whence int) (int64, error) {
+	return r.f.Seek(offset, whence)
+}
+
+// benchmarkStore returns encoded store with many records
+func benchmarkStore(b *testing.B) []byte {
+	var s Store
+	for i := 0; i < 10000; i++ {
+		s.Records = append(s.Records, NewBlobRecord(fmt.Sprintf("file%05d.txt", i), CodeIloc, make([]byte, 16)))
+		s.Records = append(s.Records, NewStringRecord(fmt.Sprintf("file%05d.txt", i), CodeCmmt, "comment"))
+	}
+	buffer := new(bytes.Buffer)
+	if err := s.Write(buffer); err != nil {
+		b.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func BenchmarkRead(b *testing.B) {
+	data := benchmarkStore(b)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var s Store
+		if err := s.Read(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	var s Store
+	if err := s.Read(bytes.NewReader(benchmarkStore(b))); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.Write(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWalk(b *testing.B) {
+	data := benchmarkStore(b)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := Walk(bytes.NewReader(data), func(r Record) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(".", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	var s Store
+	// B-tree with internal nodes
+	for i := 0; i < 2000; i++ {
+		s.Records = append(s.Records, NewBlobRecord(fmt.Sprintf("file%05d.txt", i), CodeIloc, make([]byte, 16)))
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	tests := []struct {
+		data    []byte
+		options ReadOptions
+		limited bool
+	}{
+		{data, ReadOptions{MaxInputSize: int64(len(data)), MaxRecords: 6, MaxNameLength: 16, MaxDepth: 1}, false},
+		{data, ReadOptions{MaxInputSize: int64(len(data) - 1)}, true},
+		{data, ReadOptions{MaxRecords: 5}, true},
+		{data, ReadOptions{MaxBlobSize: 16}, true},
+		{data, ReadOptions{MaxNameLength: 15}, true},
+		{data, ReadOptions{MaxRecords: 5, Lenient: true}, true},
+		{bufferWrite.Bytes(), ReadOptions{MaxDepth: 2}, false},
+		{bufferWrite.Bytes(), ReadOptions{MaxDepth: 1}, true},
+		{bufferWrite.Bytes(), ReadOptions{MaxDepth: 1, Lenient: true}, true},
+	}
+	for i, test := range tests {
+		err := s.ReadWithOptions(bytes.NewReader(test.data), test.options)
+		if test.limited != errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+		}
+	}
+	// cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.ReadContext(ctx, bytes.NewReader(data), ReadOptions{Lenient: true}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestIconLocation(t *testing.T) {
+	var s1, s2 Store
+	if err := s1.ReadFile(filepath.Join(".", "testdata", "00.DS_Store")); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	l, ok, err := s1.IconLocation("applications")
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !ok || l != NewIconLocation(268, 64) {
+		t.Errorf("Invalid icon location %v", l)
+		return
+	}
+	if _, ok, _ := s1.IconLocation("missing"); ok {
+		t.Errorf("Icon location of missing file is found")
+		return
+	}
+	// change existing location and add the new one
+	s1.SetIconLocation("Applications", NewIconLocation(400, 120))
+	s1.SetIconLocation("Background", NewIconLocation(10, 20))
+	if len(s1.Records) != 7 || s1.Records[4].FileName != "Applications" || s1.Records[5].FileName != "Background" {
+		t.Errorf("Invalid records order")
+		return
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	for _, test := range []struct {
+		fileName string
+		x, y     uint32
+	}{{"Applications", 400, 120}, {"Background", 10, 20}, {"Getscreen.me.app", 88, 64}} {
+		l, ok, err := s2.IconLocation(test.fileName)
+		if err != nil || !ok || l.X != test.x || l.Y != test.y {
+			t.Errorf("Invalid icon location of %s: %v, %v", test.fileName, l, err)
+		}
+	}
+	// invalid layout
+	s2.Set(NewBlobRecord("Applications", CodeIloc, make([]byte, 12)))
+	if _, _, err := s2.IconLocation("Applications"); err == nil {
+		t.Errorf("Invalid Iloc size is accepted")
+	}
+}
+
+func TestWindowSettings(t *testing.T) {
+	var s1, s2 Store
+	if err := s1.ReadFile(filepath.Join(".", "testdata", "00.DS_Store")); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	w, ok, err := s1.WindowSettings()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !ok || w.WindowBounds != (Rect{200, 458, 360, 222}) || w.ShowToolbar || w.ShowSidebar {
+		t.Errorf("Invalid window settings %v", w)
+		return
+	}
+	if width, ok := w.Extra["SidebarWidthTenElevenOrLater"]; !ok || width != 284.0 {
+		t.Errorf("Unknown key is lost: %v", w.Extra)
+		return
+	}
+	// change the window and write it back
+	w.WindowBounds.Width, w.WindowBounds.Height = 640, 480
+	w.ShowToolbar = true
+	w.SidebarWidth = 150
+	if err := s1.SetWindowSettings(w); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	w2, ok, err := s2.WindowSettings()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !ok || !reflect.DeepEqual(w, w2) {
+		t.Errorf("Window settings are different: %v != %v", w, w2)
+		return
+	}
+	// rectangles
+	if r, err := ParseRect("{{-10,20},{300, 400}}"); err != nil || r != (Rect{-10, 20, 300, 400}) {
+		t.Errorf("Invalid rectangle %v, %v", r, err)
+	}
+	for _, s := range []string{"", "{{1, 2}, {3}}", "{{1, 2}, {3, 4}}x", "{1, 2, 3, 4}"} {
+		if _, err := ParseRect(s); err == nil {
+			t.Errorf("Invalid rectangle %q is accepted", s)
+		}
+	}
+	// invalid value type
+	s2.Set(NewBlobRecord(".", CodeBwsp, []byte("bplist")))
+	if _, _, err := s2.WindowSettings(); err == nil {
+		t.Errorf("Invalid bwsp plist is accepted")
+	}
+}
+
+func TestIconViewOptions(t *testing.T) {
+	var s1, s2 Store
+	if err := s1.ReadFile(filepath.Join(".", "testdata", "00.DS_Store")); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	o, ok, err := s1.IconViewOptions()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !ok || o.IconSize != 48 || o.TextSize != 12 || o.GridSpacing != 100 || o.ArrangeBy != "none" ||
+		!o.LabelOnBottom || o.ShowItemInfo || !o.ShowIconPreview || o.BackgroundType != BackgroundDefault ||
+		o.BackgroundColorRed != 1 || len(o.BackgroundImageAlias) == 0 {
+		t.Errorf("Invalid icon view options %v", o)
+		return
+	}
+	if version, ok := o.Extra["viewOptionsVersion"]; !ok || version != int64(1) {
+		t.Errorf("Unknown key is lost: %v", o.Extra)
+		return
+	}
+	// change the options and write them back
+	o.IconSize = 128
+	o.ArrangeBy = "name"
+	o.BackgroundType = BackgroundColor
+	o.BackgroundColorGreen = 0.5
+	if err := s1.SetIconViewOptions(o); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	o2, ok, err := s2.IconViewOptions()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !ok || !reflect.DeepEqual(o, o2) {
+		t.Errorf("Icon view options are different: %v != %v", o, o2)
+		return
+	}
+	// invalid value type
+	data, err := plist.Encode(map[string]interface{}{"iconSize": "big"})
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if _, err := ParseIconViewOptions(data); err == nil {
+		t.Errorf("Invalid iconSize is accepted")
+	}
+}
+
+func TestListViewOptions(t *testing.T) {
+	var s1, s2 Store
+	// lsvp with columns dict, lsvP with columns array
+	lsvp, err := plist.Encode(map[string]interface{}{
+		"columns": map[string]interface{}{
+			"name":         map[string]interface{}{"visible": true, "width": int64(300), "ascending": true, "index": int64(0)},
+			"size":         map[string]interface{}{"visible": true, "width": 97.0, "ascending": false, "index": int64(2)},
+			"dateModified": map[string]interface{}{"visible": false, "width": int64(181), "ascending": false, "index": int64(1)},
+		},
+		"sortColumn":         "name",
+		"iconSize":           16.0,
+		"textSize":           13.0,
+		"useRelativeDates":   true,
+		"calculateAllSizes":  false,
+		"viewOptionsVersion": int64(1),
+	})
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	lsvP, err := plist.Encode(map[string]interface{}{
+		"columns": []interface{}{
+			map[string]interface{}{"identifier": "name", "visible": true, "width": int64(250), "ascending": true},
+			map[string]interface{}{"identifier": "kind", "visible": true, "width": int64(115), "ascending": true, "tag": "x"},
+		},
+		"sortColumn": "kind",
+	})
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	s1.Set(NewBlobRecord(".", CodeLsvp, lsvp))
+	s1.Set(NewBlobRecord(".", CodeLsvP, lsvP))
+	o, ok, err := s1.ListViewOptions(CodeLsvp)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !ok || o.ColumnsArray || len(o.Columns) != 3 || o.SortColumn != "name" || o.TextSize != 13 || !o.UseRelativeDates {
+		t.Errorf("Invalid list view options %v", o)
+		return
+	}
+	if c := o.Columns[1]; c.Identifier != "dateModified" || c.Visible || c.Width != 181 || c.Index != 1 {
+		t.Errorf("Invalid column %v", c)
+		return
+	}
+	if o.Columns[2].Width != 97 || o.Extra["viewOptionsVersion"] != int64(1) {
+		t.Errorf("Invalid list view options %v", o)
+		return
+	}
+	o2, ok, err := s1.ListViewOptions(CodeLsvP)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !ok || !o2.ColumnsArray || len(o2.Columns) != 2 || o2.Columns[1].Identifier != "kind" || o2.Columns[1].Index != 1 ||
+		o2.Columns[1].Extra["tag"] != "x" {
+		t.Errorf("Invalid list view options %v", o2)
+		return
+	}
+	// change the options, set legacy options and write them back
+	o.Columns[1].Visible = true
+	o.CalculateAllSizes = true
+	if err := s1.SetListViewOptions(CodeLsvp, o); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	legacy := ListViewOptions{TextSize: 12, Legacy: bytes.Repeat([]byte{1}, 76)}
+	if err := s1.SetListViewOptions(CodeLsvo, legacy); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	bufferWrite := new(bytes.Buffer)
+	if err := s1.Write(bufferWrite); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if err := s2.Read(bytes.NewBuffer(bufferWrite.Bytes())); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	for _, test := range []struct {
+		code FourCC
+		o    ListViewOptions
+	}{{CodeLsvp, o}, {CodeLsvP, o2}} {
+		o, ok, err := s2.ListViewOptions(test.code)
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		if !ok || !reflect.DeepEqual(o, test.o) {
+			t.Errorf("List view options %s are different: %v != %v", test.code, o, test.o)
+			return
+		}
+	}
+	if r, ok := s2.Find(".", CodeLsvt); !ok || r.Type != TypeShort {
+		t.Errorf("Invalid lsvt record %v", r)
+		return
+	}
+	if o, ok, err := s2.ListViewOptions(CodeLsvo); err != nil || !ok || !reflect.DeepEqual(o, legacy) {
+		t.Errorf("Legacy list view options are different: %v != %v, %v", o, legacy, err)
+		return
+	}
+	if err := s2.SetListViewOptions(CodeLsvo, o); err == nil {
+		t.Errorf("Legacy list view options with columns are accepted")
+	}
+	if err := s2.SetListViewOptions(CodeLsvo, ListViewOptions{TextSize: 12.5}); err == nil {
+		t.Errorf("Fractional legacy text size is accepted")
+	}
+	// invalid options
+	if _, _, err := s2.ListViewOptions(CodeIcvp); err == nil {
+		t.Errorf("Invalid list view code is accepted")
+	}
+	o.Columns[1].Identifier = "name"
+	if err := s2.SetListViewOptions(CodeLsvp, o); err == nil {
+		t.Errorf("Duplicate column is accepted")
+	}
+	data, err := plist.Encode(map[string]interface{}{"columns": "name"})
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if _, err := ParseListViewOptions(data); err == nil {
+		t.Errorf("Invalid columns are accepted")
+	}
+}
@@ -0,0 +1,500 @@
+package dsstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// ReadWriterAt is the file which can be read and written at any position (*os.File for example)
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Editor changes records of .DS_Store in place.
+// Every change rewrites only B-tree nodes which are changed, the DSDB block, the root block and the header.
+// Blocks are allocated through the free list of the file, unknown blocks and data are kept as they are.
+type Editor struct {
+	*File
+	w         io.WriterAt
+	allocator *Allocator
+	indexRoot int                  // index of the root block in offsets table
+	store     Store                // encoder of records
+	nodes     map[uint32]*editNode // nodes read by the current change
+	dirty     map[uint32]bool      // nodes changed by the current change
+	removed   []uint32             // nodes removed by the current change
+}
+
+// editNode is B-tree node read by the editor
+type editNode struct {
+	index    uint32
+	records  []Record
+	children []uint32 // child nodes (internal nodes only), len(records)+1
+}
+
+// editSplit is the result of node split: separator record and the new right node
+type editSplit struct {
+	record Record
+	index  uint32
+}
+
+// NewEditor opens .DS_Store with the given size for editing
+func NewEditor(rw ReadWriterAt, size int64) (*Editor, error) {
+	f, err := Open(rw, size)
+	if err != nil {
+		return nil, err
+	}
+	allocator, err := f.Allocator()
+	if err != nil {
+		return nil, newParseError(StageRoot, -1, int64(f.rootOffset)+4, err)
+	}
+	// the root block is rewritten by every change, so it must be found before any write
+	indexRoot := -1
+	for i, offset := range f.offsets {
+		if offset != 0 && blockOffset(offset) == f.rootOffset {
+			indexRoot = i
+		}
+	}
+	if indexRoot < 0 {
+		return nil, newParseError(StageRoot, -1, int64(f.rootOffset)+4, ErrBadBlock)
+	}
+	return &Editor{File: f, w: rw, allocator: allocator, indexRoot: indexRoot}, nil
+}
+
+// Insert adds the record. It returns ErrRecordExists if the record with the same file name and code exists
+func (e *Editor) Insert(r Record) error {
+	return e.change(r, false)
+}
+
+// Update replaces the record with the same file name and code. It returns ErrRecordNotFound if there is no such record
+func (e *Editor) Update(r Record) error {
+	return e.change(r, true)
+}
+
+// Delete removes the record with the file name and the code. It returns ErrRecordNotFound if there is no such record
+func (e *Editor) Delete(fileName string, code FourCC) error {
+	e.begin()
+	split, err := e.remove(e.tree.root, fileName, code, 0)
+	if err != nil {
+		return err
+	}
+	e.tree.records--
+	if err := e.grow(split); err != nil {
+		return err
+	}
+	// root without records is replaced by its only child
+	root, err := e.load(e.tree.root, 0)
+	if err != nil {
+		return err
+	}
+	if len(root.records) == 0 && len(root.children) == 1 {
+		e.drop(root.index)
+		e.tree.root = root.children[0]
+		e.tree.levels--
+	}
+	return e.commit()
+}
+
+func (e *Editor) change(r Record, update bool) error {
+	// check that the record can be encoded
+	if err := e.store.writeRecord(new(bytes.Buffer), r); err != nil {
+		return err
+	}
+	e.begin()
+	split, err := e.put(e.tree.root, r, update, 0)
+	if err != nil {
+		return err
+	}
+	if !update {
+		e.tree.records++
+	}
+	if err := e.grow(split); err != nil {
+		return err
+	}
+	return e.commit()
+}
+
+// begin clears nodes of the previous change
+func (e *Editor) begin() {
+	e.nodes = make(map[uint32]*editNode)
+	e.dirty = make(map[uint32]bool)
+	e.removed = nil
+}
+
+// load reads the node or returns the node which was read by the current change
+func (e *Editor) load(index uint32, depth int) (*editNode, error) {
+	if n, ok := e.nodes[index]; ok {
+		return n, nil
+	}
+	if depth >= maxTreeDepth {
+		return nil, newParseError(StageNode, int(index), e.position(index), ErrTooDeep)
+	}
+	records, children, err := e.readNode(index)
+	if err != nil {
+		return nil, err
+	}
+	n := &editNode{index: index, records: records, children: children}
+	e.nodes[index] = n
+	return n, nil
+}
+
+// create adds the new node with the new block
+func (e *Editor) create(records []Record, children []uint32) (*editNode, error) {
+	value, err := e.allocator.Alloc(nodePageSize)
+	if err != nil {
+		return nil, err
+	}
+	// the first unused index which is not the index of a topic without block
+	reserved := make(map[uint32]bool)
+	for _, t := range e.topics {
+		reserved[t.Index] = true
+	}
+	index := uint32(len(e.offsets))
+	for i, offset := range e.offsets {
+		if offset == 0 && !reserved[uint32(i)] {
+			index = uint32(i)
+			break
+		}
+	}
+	if index == uint32(len(e.offsets)) {
+		e.offsets = append(e.offsets, 0)
+	}
+	e.offsets[index] = value
+	n := &editNode{index: index, records: records, children: children}
+	e.nodes[index] = n
+	e.dirty[index] = true
+	e.tree.nodes++
+	return n, nil
+}
+
+// drop removes the node
+func (e *Editor) drop(index uint32) {
+	delete(e.nodes, index)
+	delete(e.dirty, index)
+	e.removed = append(e.removed, index)
+	e.tree.nodes--
+}
+
+// search returns position of the first record which is not less than the key and whether it is equal
+func (e *Editor) search(n *editNode, fileName string, code FourCC) (int, bool) {
+	i := sort.Search(len(n.records), func(i int) bool {
+		return compareKeys(n.records[i].FileName, n.records[i].Code(), fileName, code) >= 0
+	})
+	return i, i < len(n.records) && compareKeys(n.records[i].FileName, n.records[i].Code(), fileName, code) == 0
+}
+
+// nodeSize returns size of encoded node
+func (e *Editor) nodeSize(n *editNode) int {
+	size := 8
+	for _, r := range n.records {
+		// name length, name, code, type and data
+		size += 12 + 2*lengthUTF16(r.FileName) + len(r.Data)
+		if s, _ := valueSize(r.Type); s < 0 {
+			size += 4
+		}
+		// child index
+		if len(n.children) > 0 {
+			size += 4
+		}
+	}
+	return size
+}
+
+// split splits overflowed node by halves. The middle record goes up to the parent node
+func (e *Editor) split(n *editNode) (*editSplit, error) {
+	e.dirty[n.index] = true
+	if e.nodeSize(n) <= int(nodePageSize) || len(n.records) < 3 {
+		return nil, nil
+	}
+	m := len(n.records) / 2
+	right := &editNode{records: append([]Record{}, n.records[m+1:]...)}
+	if len(n.children) > 0 {
+		right.children = append([]uint32{}, n.children[m+1:]...)
+		n.children = n.children[:m+1]
+	}
+	record := n.records[m]
+	n.records = n.records[:m]
+	created, err := e.create(right.records, right.children)
+	if err != nil {
+		return nil, err
+	}
+	return &editSplit{record: record, index: created.index}, nil
+}
+
+// insert inserts the separator and the right node of splitted child i
+func (e *Editor) insert(n *editNode, i int, split *editSplit) {
+	n.records = append(n.records[:i], append([]Record{split.record}, n.records[i:]...)...)
+	n.children = append(n.children[:i+1], append([]uint32{split.index}, n.children[i+1:]...)...)
+}
+
+// grow adds the new root if the root node was splitted
+func (e *Editor) grow(split *editSplit) error {
+	if split == nil {
+		return nil
+	}
+	root, err := e.create([]Record{split.record}, []uint32{e.tree.root, split.index})
+	if err != nil {
+		return err
+	}
+	e.tree.root = root.index
+	e.tree.levels++
+	return nil
+}
+
+func (e *Editor) put(index uint32, r Record, update bool, depth int) (*editSplit, error) {
+	n, err := e.load(index, depth)
+	if err != nil {
+		return nil, err
+	}
+	i, found := e.search(n, r.FileName, r.Code())
+	if found {
+		if !update {
+			return nil, ErrRecordExists
+		}
+		n.records[i] = r
+		return e.split(n)
+	}
+	if len(n.children) == 0 {
+		if update {
+			return nil, ErrRecordNotFound
+		}
+		n.records = append(n.records[:i], append([]Record{r}, n.records[i:]...)...)
+		return e.split(n)
+	}
+	split, err := e.put(n.children[i], r, update, depth+1)
+	if err != nil || split == nil {
+		return nil, err
+	}
+	e.insert(n, i, split)
+	return e.split(n)
+}
+
+func (e *Editor) remove(index uint32, fileName string, code FourCC, depth int) (*editSplit, error) {
+	n, err := e.load(index, depth)
+	if err != nil {
+		return nil, err
+	}
+	i, found := e.search(n, fileName, code)
+	if len(n.children) == 0 {
+		if !found {
+			return nil, ErrRecordNotFound
+		}
+		n.records = append(n.records[:i], n.records[i+1:]...)
+		return e.split(n)
+	}
+	var split *editSplit
+	var last Record
+	if found {
+		// record of internal node is replaced by the last record of the left subtree
+		last, split, err = e.removeLast(n.children[i], depth+1)
+	} else {
+		split, err = e.remove(n.children[i], fileName, code, depth+1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if split != nil {
+		e.insert(n, i, split)
+	}
+	if found {
+		position := i
+		if split != nil {
+			position++
+		}
+		n.records[position] = last
+	}
+	if split == nil {
+		if err := e.merge(n, i, depth); err != nil {
+			return nil, err
+		}
+	}
+	return e.split(n)
+}
+
+// removeLast removes the last record of the subtree
+func (e *Editor) removeLast(index uint32, depth int) (Record, *editSplit, error) {
+	n, err := e.load(index, depth)
+	if err != nil {
+		return Record{}, nil, err
+	}
+	if len(n.children) == 0 {
+		if len(n.records) == 0 {
+			return Record{}, nil, newParseError(StageNode, int(index), e.position(index), ErrBadTree)
+		}
+		last := n.records[len(n.records)-1]
+		n.records = n.records[:len(n.records)-1]
+		split, err := e.split(n)
+		return last, split, err
+	}
+	i := len(n.children) - 1
+	last, split, err := e.removeLast(n.children[i], depth+1)
+	if err != nil {
+		return Record{}, nil, err
+	}
+	if split != nil {
+		e.insert(n, i, split)
+	} else if err := e.merge(n, i, depth); err != nil {
+		return Record{}, nil, err
+	}
+	split, err = e.split(n)
+	return last, split, err
+}
+
+// merge merges child i without records with its neighbour and the separator between them
+func (e *Editor) merge(n *editNode, i int, depth int) error {
+	child, err := e.load(n.children[i], depth+1)
+	if err != nil {
+		return err
+	}
+	if len(child.records) > 0 || len(n.records) == 0 {
+		return nil
+	}
+	var target *editNode
+	var separator int
+	if i > 0 {
+		separator = i - 1
+		if target, err = e.load(n.children[i-1], depth+1); err != nil {
+			return err
+		}
+		target.records = append(target.records, n.records[separator])
+		target.children = append(target.children, child.children...)
+	} else {
+		if target, err = e.load(n.children[1], depth+1); err != nil {
+			return err
+		}
+		target.records = append([]Record{n.records[separator]}, target.records...)
+		target.children = append(append([]uint32{}, child.children...), target.children...)
+	}
+	e.drop(child.index)
+	n.records = append(n.records[:separator], n.records[separator+1:]...)
+	n.children = append(n.children[:i], n.children[i+1:]...)
+	split, err := e.split(target)
+	if err != nil || split == nil {
+		return err
+	}
+	e.insert(n, separator, split)
+	return nil
+}
+
+// writeNode writes the node to its block. The block is reallocated if the node doesn't fit it
+func (e *Editor) writeNode(n *editNode) error {
+	b := new(bytes.Buffer)
+	var next uint32
+	if len(n.children) > 0 {
+		next = n.children[len(n.records)]
+	}
+	if err := writeUint32(b, next, uint32(len(n.records))); err != nil {
+		return err
+	}
+	for i, r := range n.records {
+		if len(n.children) > 0 {
+			if err := writeUint32(b, n.children[i]); err != nil {
+				return err
+			}
+		}
+		if err := e.store.writeRecord(b, r); err != nil {
+			return err
+		}
+	}
+	return e.writeBlock(n.index, b.Bytes())
+}
+
+// writeBlock writes data to the block by index. The block is reallocated if the data doesn't fit it
+func (e *Editor) writeBlock(index uint32, data []byte) error {
+	if uint32(len(data)) > blockSize(e.offsets[index]) {
+		if err := e.allocator.Free(e.offsets[index]); err != nil {
+			return err
+		}
+		value, err := e.allocator.Alloc(uint32(len(data)))
+		if err != nil {
+			return err
+		}
+		e.offsets[index] = value
+	}
+	return e.writeAt(e.offsets[index], data)
+}
+
+// writeAt writes data to the block and clears the rest of the block
+func (e *Editor) writeAt(value uint32, data []byte) error {
+	block := make([]byte, blockSize(value))
+	copy(block, data)
+	if _, err := e.w.WriteAt(block, int64(blockOffset(value))+4); err != nil {
+		return err
+	}
+	if end := int64(blockOffset(value)+blockSize(value)) + 4; end > e.File.size {
+		e.File.size = end
+	}
+	return nil
+}
+
+// commit writes changed nodes, DSDB block, root block and header
+func (e *Editor) commit() error {
+	// B-tree nodes
+	indices := make([]uint32, 0, len(e.dirty))
+	for index := range e.dirty {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i] < indices[j]
+	})
+	for _, index := range indices {
+		if err := e.writeNode(e.nodes[index]); err != nil {
+			return err
+		}
+	}
+	for _, index := range e.removed {
+		if err := e.allocator.Free(e.offsets[index]); err != nil {
+			return err
+		}
+		e.offsets[index] = 0
+	}
+	// DSDB block keeps its extra data
+	indexDSDB, _ := findTopic(e.topics, "DSDB")
+	blockDSDB, err := e.readIndex(indexDSDB)
+	if err != nil {
+		return err
+	}
+	data := blockDSDB.Bytes()
+	for i, value := range []uint32{e.tree.root, e.tree.levels, e.tree.records, e.tree.nodes} {
+		binary.BigEndian.PutUint32(data[4*i:], value)
+	}
+	if err := e.writeAt(e.offsets[indexDSDB], data); err != nil {
+		return err
+	}
+	// root block
+	blockRoot := new(bytes.Buffer)
+	for {
+		blockRoot.Reset()
+		if err := e.store.writeOffsets(blockRoot, e.offsets); err != nil {
+			return err
+		}
+		blockRoot.Write(e.rootTopics)
+		if err := e.store.writeFreeBlocks(blockRoot, e.allocator); err != nil {
+			return err
+		}
+		blockRoot.Write(e.rootExtra)
+		if uint32(blockRoot.Len()) <= blockSize(e.offsets[e.indexRoot]) {
+			break
+		}
+		if err := e.allocator.Free(e.offsets[e.indexRoot]); err != nil {
+			return err
+		}
+		if e.offsets[e.indexRoot], err = e.allocator.Alloc(uint32(blockRoot.Len())); err != nil {
+			return err
+		}
+	}
+	if err := e.writeAt(e.offsets[e.indexRoot], blockRoot.Bytes()); err != nil {
+		return err
+	}
+	e.rootOffset = blockOffset(e.offsets[e.indexRoot])
+	e.free = e.allocator.FreeBlocks()
+	// header: offset of root block, its size and offset again
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header[0:], e.rootOffset)
+	binary.BigEndian.PutUint32(header[4:], uint32(blockRoot.Len()))
+	binary.BigEndian.PutUint32(header[8:], e.rootOffset)
+	_, err = e.w.WriteAt(header, 8)
+	return err
+}
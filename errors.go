@@ -0,0 +1,75 @@
+package dsstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Parsing errors. They are wrapped by ParseError and can be checked with errors.Is
+var (
+	ErrBadMagic    = errors.New("invalid magic")
+	ErrBadHeader   = errors.New("invalid header offset")
+	ErrTruncated   = errors.New("unexpected end of data")
+	ErrBadBlock    = errors.New("invalid block")
+	ErrBadTree     = errors.New("invalid DSDB block")
+	ErrUnknownType = errors.New("unknown record format")
+	ErrCycle       = errors.New("B-tree node is referenced twice")
+	ErrTooDeep     = errors.New("B-tree is too deep")
+)
+
+// ErrLimitExceeded is returned when the data exceeds a limit of ReadOptions
+var ErrLimitExceeded = errors.New("limit is exceeded")
+
+// Editing errors
+var (
+	ErrRecordExists   = errors.New("record already exists")
+	ErrRecordNotFound = errors.New("record is not found")
+)
+
+// ParseError stages
+const (
+	StageHeader = "header" // file header
+	StageRoot   = "root"   // root (bookkeeping) block: offsets, topics and free blocks
+	StageDSDB   = "DSDB"   // DSDB block with B-tree header
+	StageNode   = "node"   // B-tree node
+	StageRecord = "record" // record of B-tree node
+)
+
+// ParseError is .DS_Store parsing error with its location
+type ParseError struct {
+	Stage      string // parsing stage (Stage* constants)
+	BlockIndex int    // index of the block in offsets table, -1 for header and root block
+	Offset     int64  // byte offset in the file, -1 when it is unknown
+	Err        error  // underlying error
+}
+
+func (e *ParseError) Error() string {
+	if e.BlockIndex < 0 {
+		return fmt.Sprintf("%s at offset %d: %s", e.Stage, e.Offset, e.Err.Error())
+	}
+	return fmt.Sprintf("%s (block %d) at offset %d: %s", e.Stage, e.BlockIndex, e.Offset, e.Err.Error())
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// newParseError wraps err into ParseError. ParseError is returned as is
+func newParseError(stage string, index int, offset int64, err error) error {
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		return err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return &ParseError{Stage: stage, BlockIndex: index, Offset: offset, Err: err}
+}
+
+// blockPosition returns file offset of the current position in the block data
+func blockPosition(offset, size uint32, b *bytes.Buffer) int64 {
+	return int64(offset) + 4 + int64(size) - int64(b.Len())
+}
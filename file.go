@@ -0,0 +1,332 @@
+package dsstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ErrStop can be returned by iteration callback to stop iteration without error
+var ErrStop = errors.New("stop iteration")
+
+// File is .DS_Store opened for random access.
+// It reads the header, the root block and the DSDB block on opening,
+// B-tree nodes are read on demand and records are not kept in memory.
+type File struct {
+	r          io.ReaderAt
+	size       int64
+	rootOffset uint32   // offset of root block from header
+	offsets    []uint32 // block offsets
+	topics     []Topic
+	rootTopics []byte     // raw topics of root block
+	free       [][]uint32 // free blocks by log2 of size
+	rootExtra  []byte     // root block data after free blocks
+	tree       treeHeader // DSDB B-tree header
+}
+
+// Open opens .DS_Store from io.ReaderAt with the given size
+func Open(r io.ReaderAt, size int64) (*File, error) {
+	f := &File{r: r, size: size}
+	// header
+	header := make([]byte, 36)
+	if size < int64(len(header)) {
+		return nil, newParseError(StageHeader, -1, 0, ErrTruncated)
+	}
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, newParseError(StageHeader, -1, 0, err)
+	}
+	blockHeader := bytes.NewBuffer(header)
+	offset, rootSize, err := readHeader(blockHeader)
+	if err != nil {
+		return nil, newParseError(StageHeader, -1, int64(len(header)-blockHeader.Len()-4), err)
+	}
+	// root block
+	blockRoot, err := f.readBlock(offset, rootSize)
+	if err != nil {
+		return nil, newParseError(StageRoot, -1, int64(offset)+4, err)
+	}
+	f.rootOffset = offset
+	if f.offsets, err = readOffsets(blockRoot); err != nil {
+		return nil, newParseError(StageRoot, -1, blockPosition(offset, rootSize, blockRoot), err)
+	}
+	topics := blockRoot.Bytes()
+	if f.topics, err = readTopics(blockRoot); err != nil {
+		return nil, newParseError(StageRoot, -1, blockPosition(offset, rootSize, blockRoot), err)
+	}
+	f.rootTopics = topics[:len(topics)-blockRoot.Len()]
+	if f.free, err = readFreeBlocks(blockRoot); err != nil {
+		return nil, newParseError(StageRoot, -1, blockPosition(offset, rootSize, blockRoot), err)
+	}
+	f.rootExtra = blockRoot.Bytes()
+	// DSDB block
+	node, ok := findTopic(f.topics, "DSDB")
+	if !ok {
+		return nil, newParseError(StageDSDB, -1, -1, ErrBadTree)
+	}
+	blockDSDB, err := f.readIndex(node)
+	if err != nil {
+		return nil, newParseError(StageDSDB, int(node), f.position(node), err)
+	}
+	if f.tree, err = readTreeHeader(blockDSDB); err != nil {
+		return nil, newParseError(StageDSDB, int(node), f.position(node), err)
+	}
+	return f, nil
+}
+
+// readBlock reads block data
+func (f *File) readBlock(offset, size uint32) (*bytes.Buffer, error) {
+	if int64(offset)+4+int64(size) > f.size {
+		return nil, ErrBadBlock
+	}
+	data := make([]byte, size)
+	if _, err := f.r.ReadAt(data, int64(offset)+4); err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(data), nil
+}
+
+// readIndex reads block by index
+func (f *File) readIndex(index uint32) (*bytes.Buffer, error) {
+	if int(index) >= len(f.offsets) || f.offsets[index] == 0 {
+		return nil, ErrBadBlock
+	}
+	offset := f.offsets[index]
+	return f.readBlock(blockOffset(offset), blockSize(offset))
+}
+
+// position returns file offset of the block data or -1 for invalid index
+func (f *File) position(index uint32) int64 {
+	if int(index) >= len(f.offsets) || f.offsets[index] == 0 {
+		return -1
+	}
+	return int64(blockOffset(f.offsets[index])) + 4
+}
+
+// readNode reads B-tree node. It returns records and child node indices (internal nodes only)
+func (f *File) readNode(index uint32) ([]Record, []uint32, error) {
+	blockData, err := f.readIndex(index)
+	if err != nil {
+		return nil, nil, newParseError(StageNode, int(index), f.position(index), err)
+	}
+	// position of the current data
+	size := uint32(blockData.Len())
+	position := func() int64 {
+		return f.position(index) + int64(size) - int64(blockData.Len())
+	}
+	var nextNode uint32
+	if err := readUint32(blockData, &nextNode); err != nil {
+		return nil, nil, newParseError(StageNode, int(index), position(), err)
+	}
+	var count uint32
+	if err := readUint32(blockData, &count); err != nil {
+		return nil, nil, newParseError(StageNode, int(index), position(), err)
+	}
+	records := make([]Record, 0)
+	children := make([]uint32, 0)
+	for i := 0; i < int(count); i++ {
+		if nextNode > 0 {
+			var childNode uint32
+			if err := readUint32(blockData, &childNode); err != nil {
+				return nil, nil, newParseError(StageNode, int(index), position(), err)
+			}
+			children = append(children, childNode)
+		}
+		recordPosition := position()
+		r, err := readParseFile(blockData)
+		if err != nil {
+			return nil, nil, newParseError(StageRecord, int(index), recordPosition, err)
+		}
+		records = append(records, r)
+	}
+	if nextNode > 0 {
+		children = append(children, nextNode)
+	}
+	return records, children, nil
+}
+
+// checkNode protects against cycles and too deep trees
+func (f *File) checkNode(index uint32, visited map[uint32]bool, depth int) error {
+	if visited[index] {
+		return newParseError(StageNode, int(index), f.position(index), ErrCycle)
+	}
+	if depth >= maxTreeDepth {
+		return newParseError(StageNode, int(index), f.position(index), ErrTooDeep)
+	}
+	visited[index] = true
+	return nil
+}
+
+func (f *File) each(index uint32, fn func(Record) error, visited map[uint32]bool, depth int) error {
+	if err := f.checkNode(index, visited, depth); err != nil {
+		return err
+	}
+	records, children, err := f.readNode(index)
+	if err != nil {
+		return err
+	}
+	for i, r := range records {
+		if len(children) > 0 {
+			if err := f.each(children[i], fn, visited, depth+1); err != nil {
+				return err
+			}
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	if len(children) > 0 {
+		return f.each(children[len(records)], fn, visited, depth+1)
+	}
+	return nil
+}
+
+// Allocator returns the allocator loaded with free blocks of the file
+func (f *File) Allocator() (*Allocator, error) {
+	a := new(Allocator)
+	if err := a.load(f.free); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Len returns count of records stored in DSDB header
+func (f *File) Len() int {
+	return int(f.tree.records)
+}
+
+// Each calls fn for every record in B-tree order.
+// Iteration stops when fn returns error, ErrStop stops it without error
+func (f *File) Each(fn func(Record) error) error {
+	err := f.each(f.tree.root, fn, make(map[uint32]bool), 0)
+	if err == ErrStop {
+		return nil
+	}
+	return err
+}
+
+func (f *File) find(index uint32, fileName string, code FourCC, depth int) (Record, bool, error) {
+	if depth >= maxTreeDepth {
+		return Record{}, false, newParseError(StageNode, int(index), f.position(index), ErrTooDeep)
+	}
+	records, children, err := f.readNode(index)
+	if err != nil {
+		return Record{}, false, err
+	}
+	// records of the node are sorted, find the first one which is not less than the key
+	for i, r := range records {
+		c := compareKeys(r.FileName, r.Code(), fileName, code)
+		if c == 0 {
+			return r, true, nil
+		}
+		if c > 0 {
+			if len(children) == 0 {
+				return Record{}, false, nil
+			}
+			return f.find(children[i], fileName, code, depth+1)
+		}
+	}
+	if len(children) == 0 {
+		return Record{}, false, nil
+	}
+	return f.find(children[len(records)], fileName, code, depth+1)
+}
+
+// Find looks for the record with the file name and the property code.
+// It descends B-tree the way Finder does, so file names are compared case-insensitively
+// and only one node of every tree level is read
+func (f *File) Find(fileName string, code FourCC) (Record, bool, error) {
+	return f.find(f.tree.root, fileName, code, 0)
+}
+
+func (f *File) findAll(index uint32, fileName string, found []Record, visited map[uint32]bool, depth int) ([]Record, error) {
+	if err := f.checkNode(index, visited, depth); err != nil {
+		return nil, err
+	}
+	records, children, err := f.readNode(index)
+	if err != nil {
+		return nil, err
+	}
+	// child i contains the keys between records i-1 and i
+	for i, r := range records {
+		c := compareNames(r.FileName, fileName)
+		if len(children) > 0 && c >= 0 && (i == 0 || compareNames(records[i-1].FileName, fileName) <= 0) {
+			if found, err = f.findAll(children[i], fileName, found, visited, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		if c == 0 {
+			found = append(found, r)
+		}
+	}
+	if len(children) > 0 && (len(records) == 0 || compareNames(records[len(records)-1].FileName, fileName) <= 0) {
+		return f.findAll(children[len(records)], fileName, found, visited, depth+1)
+	}
+	return found, nil
+}
+
+// FindAll looks for all records of the file name in B-tree order.
+// It reads only nodes which can contain records of the file
+func (f *File) FindAll(fileName string) ([]Record, error) {
+	return f.findAll(f.tree.root, fileName, make([]Record, 0), make(map[uint32]bool), 0)
+}
+
+// Walk calls fn for every record of .DS_Store in B-tree order without keeping records in memory.
+// Walking stops when fn returns error, ErrStop stops it without error
+func Walk(r io.Reader, fn func(Record) error) error {
+	// readers with known size (bytes.Reader, os.File) are read on demand
+	if ra, ok := r.(io.ReaderAt); ok {
+		size, ok, err := readerSize(r)
+		if err != nil {
+			return err
+		}
+		if ok {
+			f, err := Open(ra, size)
+			if err != nil {
+				return err
+			}
+			return f.Each(fn)
+		}
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	return f.Each(fn)
+}
+
+// readerSize returns size of the reader by Size(), Stat() or seeking to the end.
+// It returns false if the size is unknown
+func readerSize(r io.Reader) (int64, bool, error) {
+	switch v := r.(type) {
+	case interface{ Size() int64 }:
+		return v.Size(), true, nil
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := v.Stat()
+		if err != nil {
+			return 0, false, err
+		}
+		// pipes and devices have no size
+		return fi.Size(), fi.Mode().IsRegular(), nil
+	case io.Seeker:
+		// the position is restored, records are read by ReadAt
+		pos, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false, nil
+		}
+		size, err := v.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, false, nil
+		}
+		if _, err := v.Seek(pos, io.SeekStart); err != nil {
+			return 0, false, err
+		}
+		return size, true, nil
+	}
+	return 0, false, nil
+}
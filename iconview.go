@@ -0,0 +1,81 @@
+package dsstore
+
+// Background types of icon view
+const (
+	BackgroundDefault = 0
+	BackgroundColor   = 1 // backgroundColorRed, backgroundColorGreen and backgroundColorBlue
+	BackgroundPicture = 2 // backgroundImageAlias
+)
+
+// IconViewOptions are icon view settings of the folder (icvp record).
+// Sizes and offsets are points, Finder stores them as reals. Other keys, like viewOptionsVersion, stay in Extra
+type IconViewOptions struct {
+	IconSize             float64
+	TextSize             float64
+	GridSpacing          float64
+	GridOffsetX          float64
+	GridOffsetY          float64
+	ArrangeBy            string // "none", "name", "kind", "dateModified", etc; empty value is not written
+	LabelOnBottom        bool
+	ShowItemInfo         bool
+	ShowIconPreview      bool
+	BackgroundType       int
+	BackgroundColorRed   float64 // color components are from 0 to 1
+	BackgroundColorGreen float64
+	BackgroundColorBlue  float64
+	BackgroundImageAlias []byte // alias record of the background picture, nil is not written
+
+	Extra map[string]interface{}
+}
+
+// properties maps icvp keys to the fields
+func (o *IconViewOptions) properties() []property {
+	return []property{
+		{"iconSize", &o.IconSize, false},
+		{"textSize", &o.TextSize, false},
+		{"gridSpacing", &o.GridSpacing, false},
+		{"gridOffsetX", &o.GridOffsetX, false},
+		{"gridOffsetY", &o.GridOffsetY, false},
+		{"arrangeBy", &o.ArrangeBy, true},
+		{"labelOnBottom", &o.LabelOnBottom, false},
+		{"showItemInfo", &o.ShowItemInfo, false},
+		{"showIconPreview", &o.ShowIconPreview, false},
+		{"backgroundType", &o.BackgroundType, false},
+		{"backgroundColorRed", &o.BackgroundColorRed, false},
+		{"backgroundColorGreen", &o.BackgroundColorGreen, false},
+		{"backgroundColorBlue", &o.BackgroundColorBlue, false},
+		{"backgroundImageAlias", &o.BackgroundImageAlias, true},
+	}
+}
+
+func (o *IconViewOptions) fromDict(dict map[string]interface{}) error {
+	return parseProperties(dict, o.properties(), &o.Extra)
+}
+
+func (o *IconViewOptions) toDict() (map[string]interface{}, error) {
+	return encodeProperties(o.properties(), o.Extra)
+}
+
+// ParseIconViewOptions decodes icvp plist
+func ParseIconViewOptions(data []byte) (IconViewOptions, error) {
+	var o IconViewOptions
+	err := decodePropertyDict(data, &o)
+	return o, err
+}
+
+// Bytes encodes icon view options to icvp plist
+func (o IconViewOptions) Bytes() ([]byte, error) {
+	return encodePropertyDict(&o)
+}
+
+// IconViewOptions returns icon view options of the folder. It returns false if there is no icvp record
+func (s *Store) IconViewOptions() (IconViewOptions, bool, error) {
+	var o IconViewOptions
+	ok, err := s.readProperties(".", CodeIcvp, &o)
+	return o, ok, err
+}
+
+// SetIconViewOptions sets icon view options of the folder
+func (s *Store) SetIconViewOptions(o IconViewOptions) error {
+	return s.writeProperties(".", CodeIcvp, &o)
+}
@@ -0,0 +1,60 @@
+package dsstore
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// IconLocation is the icon position in the folder window (Iloc record)
+type IconLocation struct {
+	X        uint32  // horizontal position of the icon center
+	Y        uint32  // vertical position of the icon center
+	Reserved [8]byte // unknown trailing bytes, Finder writes ff ff ff ff ff ff 00 00
+}
+
+// iconLocationSize is the size of Iloc blob
+const iconLocationSize = 16
+
+// NewIconLocation returns the icon location with reserved bytes written by Finder
+func NewIconLocation(x, y uint32) IconLocation {
+	return IconLocation{X: x, Y: y, Reserved: [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0}}
+}
+
+// ParseIconLocation decodes 16 bytes of Iloc blob
+func ParseIconLocation(data []byte) (IconLocation, error) {
+	var l IconLocation
+	if len(data) != iconLocationSize {
+		return l, fmt.Errorf("invalid Iloc size %d", len(data))
+	}
+	l.X = binary.BigEndian.Uint32(data)
+	l.Y = binary.BigEndian.Uint32(data[4:])
+	copy(l.Reserved[:], data[8:])
+	return l, nil
+}
+
+// Bytes encodes the icon location to 16 bytes of Iloc blob
+func (l IconLocation) Bytes() []byte {
+	data := make([]byte, iconLocationSize)
+	binary.BigEndian.PutUint32(data, l.X)
+	binary.BigEndian.PutUint32(data[4:], l.Y)
+	copy(data[8:], l.Reserved[:])
+	return data
+}
+
+// IconLocation returns the icon location of the file. It returns false if there is no Iloc record
+func (s *Store) IconLocation(fileName string) (IconLocation, bool, error) {
+	r, ok := s.Find(fileName, CodeIloc)
+	if !ok {
+		return IconLocation{}, false, nil
+	}
+	if r.Type != TypeBlob {
+		return IconLocation{}, true, fmt.Errorf("invalid Iloc type %s", r.Type)
+	}
+	l, err := ParseIconLocation(r.Data)
+	return l, true, err
+}
+
+// SetIconLocation sets the icon location of the file
+func (s *Store) SetIconLocation(fileName string, l IconLocation) {
+	s.Set(NewBlobRecord(fileName, CodeIloc, l.Bytes()))
+}
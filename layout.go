@@ -0,0 +1,177 @@
+package dsstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// layout is the block layout of the file which was read
+type layout struct {
+	data       []byte      // original file data
+	offsetRoot uint32      // offset of root block from header
+	sizeRoot   uint32      // size of root block from header
+	rootHead   []byte      // root block data before extra: offsets, topics and free blocks
+	topics     []Topic     // copy of topics which were read, rootHead is valid for them only
+	freeBlocks [][]uint32  // free blocks by power of 2 sizes
+	offsetDSDB uint32      // offset value of DSDB block
+	root       uint32      // index of B-tree root node
+	levels     uint32      // levels of internal nodes
+	nodes      uint32      // count of nodes
+	tree       *layoutNode // B-tree root node
+}
+
+// layoutNode is B-tree node of the file which was read
+type layoutNode struct {
+	index    uint32        // block index
+	offset   uint32        // offset value of the block
+	count    int           // count of records
+	size     int           // size of node data in bytes
+	children []*layoutNode // child nodes (internal nodes only), count+1
+}
+
+var errLayoutChanged = errors.New("records don't fit the layout")
+
+// copyTopics returns deep copy of topics with their blocks
+func copyTopics(topics []Topic) []Topic {
+	c := make([]Topic, len(topics))
+	for i, t := range topics {
+		c[i] = Topic{Name: t.Name, Index: t.Index}
+		if t.Blocks != nil {
+			c[i].Blocks = make(map[uint32][]byte, len(t.Blocks))
+			for index, data := range t.Blocks {
+				c[i].Blocks[index] = append([]byte{}, data...)
+			}
+		}
+	}
+	return c
+}
+
+// equalTopics reports whether topics have the same names, indices and blocks
+func equalTopics(a, b []Topic) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Index != b[i].Index || len(a[i].Blocks) != len(b[i].Blocks) {
+			return false
+		}
+		for index, data := range a[i].Blocks {
+			other, ok := b[i].Blocks[index]
+			if !ok || !bytes.Equal(data, other) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// writeLayoutBlock writes block data at the place of the block and clears the rest of previous data
+func (s *Store) writeLayoutBlock(fileData []byte, offset uint32, data []byte, prevSize int) error {
+	if uint32(len(data)) > blockSize(offset) {
+		return errLayoutChanged
+	}
+	block := fileData[4+blockOffset(offset) : 4+blockOffset(offset)+blockSize(offset)]
+	copy(block, data)
+	for i := len(data); i < prevSize; i++ {
+		block[i] = 0
+	}
+	return nil
+}
+
+// writeLayoutNode writes node with the records taken in order of B-tree traversal
+func (s *Store) writeLayoutNode(fileData []byte, n *layoutNode, records [][]byte) ([][]byte, error) {
+	b := new(bytes.Buffer)
+	var next uint32
+	if len(n.children) > 0 {
+		next = n.children[n.count].index
+	}
+	if err := writeUint32(b, next); err != nil {
+		return nil, err
+	}
+	if err := writeUint32(b, uint32(n.count)); err != nil {
+		return nil, err
+	}
+	for i := 0; i < n.count; i++ {
+		if len(n.children) > 0 {
+			var err error
+			if records, err = s.writeLayoutNode(fileData, n.children[i], records); err != nil {
+				return nil, err
+			}
+			if err := writeUint32(b, n.children[i].index); err != nil {
+				return nil, err
+			}
+		}
+		if len(records) == 0 {
+			return nil, errLayoutChanged
+		}
+		if _, err := b.Write(records[0]); err != nil {
+			return nil, err
+		}
+		records = records[1:]
+	}
+	if len(n.children) > 0 {
+		var err error
+		if records, err = s.writeLayoutNode(fileData, n.children[n.count], records); err != nil {
+			return nil, err
+		}
+	}
+	return records, s.writeLayoutBlock(fileData, n.offset, b.Bytes(), n.size)
+}
+
+// writeLayout writes the store into the blocks of the file which was read
+func (s *Store) writeLayout(w io.Writer) error {
+	l := s.layout
+	// root block and topic blocks are kept as they were read
+	if !equalTopics(s.Topics, l.topics) {
+		return errLayoutChanged
+	}
+	fileData := append([]byte{}, l.data...)
+	// encode records in Finder order
+	records := make([][]byte, len(s.Records))
+	for i, r := range sortRecords(s.Records) {
+		b := new(bytes.Buffer)
+		if err := s.writeRecord(b, r); err != nil {
+			return err
+		}
+		records[i] = b.Bytes()
+	}
+	// B-tree nodes
+	rest, err := s.writeLayoutNode(fileData, l.tree, records)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errLayoutChanged
+	}
+	// DSDB block
+	blockDSDB := new(bytes.Buffer)
+	if err := writeUint32(blockDSDB, l.root, l.levels, uint32(len(s.Records)), l.nodes, nodePageSize); err != nil {
+		return err
+	}
+	if _, err := blockDSDB.Write(s.DSDBExtra); err != nil {
+		return err
+	}
+	// DSDBExtra was read up to the end of the block, shorter extra leaves zeros
+	if err := s.writeLayoutBlock(fileData, l.offsetDSDB, blockDSDB.Bytes(), int(blockSize(l.offsetDSDB))); err != nil {
+		return err
+	}
+	// root block with extra data
+	blockRoot := append(append([]byte{}, l.rootHead...), s.RootExtra...)
+	if uint32(len(blockRoot)) > l.sizeRoot {
+		return errLayoutChanged
+	}
+	copy(fileData[4+l.offsetRoot:], blockRoot)
+	// shorter extra leaves zeros up to the size which was read
+	for i := l.offsetRoot + 4 + uint32(len(blockRoot)); i < l.offsetRoot+4+l.sizeRoot; i++ {
+		fileData[i] = 0
+	}
+	// header
+	blockHeader := new(bytes.Buffer)
+	if err := s.writeHeader(blockHeader, l.offsetRoot, uint32(len(blockRoot))); err != nil {
+		return err
+	}
+	copy(fileData, blockHeader.Bytes())
+	_, err = w.Write(fileData)
+	return err
+}
@@ -0,0 +1,227 @@
+package dsstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ListViewColumn is the column of list view. Other keys of the column stay in Extra
+type ListViewColumn struct {
+	Identifier string // "name", "dateModified", "size", "kind", etc
+	Visible    bool
+	Width      int
+	Ascending  bool
+	Index      int // position of the column, columns of array are indexed by their order
+
+	Extra map[string]interface{}
+}
+
+// properties maps column keys to the fields. Items of array have identifier, items of dict have index
+func (c *ListViewColumn) properties(array bool) []property {
+	properties := []property{
+		{"visible", &c.Visible, false},
+		{"width", &c.Width, false},
+		{"ascending", &c.Ascending, false},
+	}
+	if array {
+		return append(properties, property{"identifier", &c.Identifier, false})
+	}
+	return append(properties, property{"index", &c.Index, false})
+}
+
+// ListViewOptions are list view settings of the folder (lsvp, lsvP and lsvC records).
+// Legacy list view is stored in lsvo and lsvt records: lsvt is the text size and lsvo is the binary
+// structure without public description. Fields of lsvo are not decoded, its data is kept in Legacy
+type ListViewOptions struct {
+	Columns           []ListViewColumn // columns ordered by Index
+	ColumnsArray      bool             // columns are stored as array instead of dict by identifier
+	SortColumn        string           // empty value is not written
+	IconSize          float64
+	TextSize          float64
+	UseRelativeDates  bool
+	CalculateAllSizes bool
+
+	Extra  map[string]interface{} // other keys, like viewOptionsVersion
+	Legacy []byte                 // raw lsvo data, nil is not written
+}
+
+// properties maps list view keys to the fields, columns are mapped separately
+func (o *ListViewOptions) properties() []property {
+	return []property{
+		{"sortColumn", &o.SortColumn, true},
+		{"iconSize", &o.IconSize, false},
+		{"textSize", &o.TextSize, false},
+		{"useRelativeDates", &o.UseRelativeDates, false},
+		{"calculateAllSizes", &o.CalculateAllSizes, false},
+	}
+}
+
+// isListViewCode reports whether the code is plist of list view options
+func isListViewCode(code FourCC) bool {
+	return code == CodeLsvp || code == CodeLsvP || code == CodeLsvC
+}
+
+func (o *ListViewOptions) fromDict(dict map[string]interface{}) error {
+	if columns, ok := dict["columns"]; ok {
+		if err := o.parseColumns(columns); err != nil {
+			return err
+		}
+		delete(dict, "columns")
+	}
+	return parseProperties(dict, o.properties(), &o.Extra)
+}
+
+// parseColumns parses columns dict by identifier or columns array
+func (o *ListViewOptions) parseColumns(columns interface{}) error {
+	switch columns := columns.(type) {
+	case map[string]interface{}:
+		for identifier, value := range columns {
+			c := ListViewColumn{Identifier: identifier}
+			if err := c.parse(value, false); err != nil {
+				return err
+			}
+			o.Columns = append(o.Columns, c)
+		}
+		sort.Slice(o.Columns, func(i, j int) bool {
+			if o.Columns[i].Index != o.Columns[j].Index {
+				return o.Columns[i].Index < o.Columns[j].Index
+			}
+			return o.Columns[i].Identifier < o.Columns[j].Identifier
+		})
+	case []interface{}:
+		o.ColumnsArray = true
+		for i, value := range columns {
+			c := ListViewColumn{Index: i}
+			if err := c.parse(value, true); err != nil {
+				return err
+			}
+			o.Columns = append(o.Columns, c)
+		}
+	default:
+		return fmt.Errorf("invalid columns value %T", columns)
+	}
+	return nil
+}
+
+// parse parses the column dict
+func (c *ListViewColumn) parse(value interface{}, array bool) error {
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid column value %T", value)
+	}
+	return parseProperties(dict, c.properties(array), &c.Extra)
+}
+
+func (o *ListViewOptions) toDict() (map[string]interface{}, error) {
+	dict, err := encodeProperties(o.properties(), o.Extra)
+	if err != nil {
+		return nil, err
+	}
+	if o.ColumnsArray {
+		columns := make([]interface{}, 0, len(o.Columns))
+		for i := range o.Columns {
+			column, err := encodeProperties(o.Columns[i].properties(true), o.Columns[i].Extra)
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, column)
+		}
+		dict["columns"] = columns
+	} else if len(o.Columns) > 0 {
+		columns := make(map[string]interface{}, len(o.Columns))
+		for i := range o.Columns {
+			c := &o.Columns[i]
+			if _, ok := columns[c.Identifier]; ok {
+				return nil, fmt.Errorf("duplicate column %q", c.Identifier)
+			}
+			if columns[c.Identifier], err = encodeProperties(c.properties(false), c.Extra); err != nil {
+				return nil, err
+			}
+		}
+		dict["columns"] = columns
+	}
+	return dict, nil
+}
+
+// ParseListViewOptions decodes lsvp, lsvP or lsvC plist
+func ParseListViewOptions(data []byte) (ListViewOptions, error) {
+	var o ListViewOptions
+	err := decodePropertyDict(data, &o)
+	return o, err
+}
+
+// Bytes encodes list view options to lsvp, lsvP or lsvC plist
+func (o ListViewOptions) Bytes() ([]byte, error) {
+	return encodePropertyDict(&o)
+}
+
+// ListViewOptions returns list view options of the folder from lsvp, lsvP or lsvC record.
+// Legacy options of lsvo code have TextSize of lsvt record and raw Legacy data of lsvo record.
+// It returns false if there is no record
+func (s *Store) ListViewOptions(code FourCC) (ListViewOptions, bool, error) {
+	var o ListViewOptions
+	if code == CodeLsvo {
+		return s.legacyListViewOptions()
+	}
+	if !isListViewCode(code) {
+		return o, false, fmt.Errorf("invalid list view code %s", code)
+	}
+	ok, err := s.readProperties(".", code, &o)
+	return o, ok, err
+}
+
+// SetListViewOptions sets list view options of the folder to lsvp, lsvP or lsvC record.
+// Legacy options of lsvo code are written to lsvt and lsvo records, they keep only TextSize and Legacy data.
+// Zero TextSize and nil Legacy don't change the records
+func (s *Store) SetListViewOptions(code FourCC, o ListViewOptions) error {
+	if code == CodeLsvo {
+		return s.setLegacyListViewOptions(o)
+	}
+	if !isListViewCode(code) {
+		return fmt.Errorf("invalid list view code %s", code)
+	}
+	return s.writeProperties(".", code, &o)
+}
+
+// legacyListViewOptions reads lsvt and lsvo records
+func (s *Store) legacyListViewOptions() (ListViewOptions, bool, error) {
+	var o ListViewOptions
+	r, found := s.Find(".", CodeLsvo)
+	if found {
+		if r.Type != TypeBlob {
+			return o, true, fmt.Errorf("invalid %s type %s", CodeLsvo, r.Type)
+		}
+		o.Legacy = append([]byte{}, r.Data...)
+	}
+	if r, ok := s.Find(".", CodeLsvt); ok {
+		found = true
+		if r.Type != TypeShort {
+			return o, true, fmt.Errorf("invalid %s type %s", CodeLsvt, r.Type)
+		}
+		v, err := r.Value()
+		if err != nil {
+			return o, true, err
+		}
+		o.TextSize = float64(v.(int16))
+	}
+	return o, found, nil
+}
+
+// setLegacyListViewOptions writes lsvt and lsvo records
+func (s *Store) setLegacyListViewOptions(o ListViewOptions) error {
+	if len(o.Columns) > 0 || o.ColumnsArray || o.SortColumn != "" || o.IconSize != 0 ||
+		o.UseRelativeDates || o.CalculateAllSizes || len(o.Extra) > 0 {
+		return errors.New("legacy list view options keep only TextSize and Legacy data")
+	}
+	if o.TextSize != float64(int16(o.TextSize)) {
+		return fmt.Errorf("invalid %s text size %v", CodeLsvt, o.TextSize)
+	}
+	if o.TextSize != 0 {
+		s.Set(NewShortRecord(".", CodeLsvt, int16(o.TextSize)))
+	}
+	if o.Legacy != nil {
+		s.Set(NewBlobRecord(".", CodeLsvo, o.Legacy))
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package plist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf16"
+)
+
+// decoder is the state of decoding
+type decoder struct {
+	data     []byte
+	offsets  []uint64 // offsets of objects
+	refSize  int      // size of object reference
+	decoding []bool   // objects which are decoded now, protects against cycles
+	depth    int
+	decoded  int               // count of decoded objects, protects against shared objects bombs
+	budget   int               // bytes which can be copied yet, protects against shared data bombs
+	strings  map[uint64]string // decoded strings by reference, shared strings are decoded once
+}
+
+// Decode decodes binary property list and returns its top object
+func Decode(data []byte) (interface{}, error) {
+	if len(data) < len(magic)+trailerSize {
+		return nil, ErrTruncated
+	}
+	if string(data[:len(magic)]) != magic {
+		return nil, ErrBadMagic
+	}
+	// trailer
+	trailer := data[len(data)-trailerSize:]
+	offsetSize := int(trailer[6])
+	refSize := int(trailer[7])
+	count := binary.BigEndian.Uint64(trailer[8:])
+	top := binary.BigEndian.Uint64(trailer[16:])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:])
+	if offsetSize < 1 || offsetSize > 8 || refSize < 1 || refSize > 8 {
+		return nil, fmt.Errorf("%w [trailer]", ErrBadObject)
+	}
+	// offsets table is located between the header and the trailer
+	tableEnd := uint64(len(data) - trailerSize)
+	if tableOffset < uint64(len(magic)) || tableOffset > tableEnd || count > (tableEnd-tableOffset)/uint64(offsetSize) {
+		return nil, ErrTruncated
+	}
+	if top >= count {
+		return nil, ErrBadRef
+	}
+	d := &decoder{data: data, refSize: refSize, offsets: make([]uint64, count), decoding: make([]bool, count),
+		budget: maxExpansion * len(data), strings: make(map[uint64]string)}
+	for i := range d.offsets {
+		d.offsets[i] = readUint(data[tableOffset+uint64(i*offsetSize):], offsetSize)
+		if d.offsets[i] < uint64(len(magic)) || d.offsets[i] >= tableOffset {
+			return nil, fmt.Errorf("%w [offset of object %d]", ErrBadObject, i)
+		}
+	}
+	return d.object(top)
+}
+
+// readUint reads big-endian unsigned integer of the size
+func readUint(p []byte, size int) uint64 {
+	var v uint64
+	for i := 0; i < size; i++ {
+		v = v<<8 | uint64(p[i])
+	}
+	return v
+}
+
+// bytes returns size bytes of the object data at the offset
+func (d *decoder) bytes(offset, size uint64) ([]byte, error) {
+	if offset > uint64(len(d.data)) || size > uint64(len(d.data))-offset {
+		return nil, ErrTruncated
+	}
+	return d.data[offset : offset+size], nil
+}
+
+// length returns count of object items and offset of the first item
+func (d *decoder) length(offset uint64, marker byte) (uint64, uint64, error) {
+	if marker&0x0f != 0x0f {
+		return uint64(marker & 0x0f), offset + 1, nil
+	}
+	// count is stored as int object
+	p, err := d.bytes(offset+1, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if p[0]&0xf0 != markerInt || p[0]&0x0f > 3 {
+		return 0, 0, fmt.Errorf("%w [length at %d]", ErrBadObject, offset)
+	}
+	size := uint64(1) << (p[0] & 0x0f)
+	if p, err = d.bytes(offset+2, size); err != nil {
+		return 0, 0, err
+	}
+	return readUint(p, int(size)), offset + 2 + size, nil
+}
+
+// refs reads references of array or dict items
+func (d *decoder) refs(offset, count uint64) ([]uint64, error) {
+	if count > uint64(len(d.data))/uint64(d.refSize) {
+		return nil, ErrTruncated
+	}
+	p, err := d.bytes(offset, count*uint64(d.refSize))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]uint64, count)
+	for i := range refs {
+		refs[i] = readUint(p[i*d.refSize:], d.refSize)
+		if refs[i] >= uint64(len(d.offsets)) {
+			return nil, ErrBadRef
+		}
+	}
+	return refs, nil
+}
+
+// object decodes object by its reference
+func (d *decoder) object(ref uint64) (interface{}, error) {
+	if d.decoding[ref] {
+		return nil, ErrCycle
+	}
+	if d.depth >= maxDepth {
+		return nil, fmt.Errorf("%w [too deep]", ErrBadObject)
+	}
+	if d.decoded++; d.decoded > maxObjects {
+		return nil, fmt.Errorf("%w [too many objects]", ErrBadObject)
+	}
+	d.decoding[ref] = true
+	d.depth++
+	defer func() {
+		d.decoding[ref] = false
+		d.depth--
+	}()
+	offset := d.offsets[ref]
+	marker := d.data[offset]
+	switch marker & 0xf0 {
+	case 0x00:
+		switch marker {
+		case markerNull:
+			return nil, nil
+		case markerFalse:
+			return false, nil
+		case markerTrue:
+			return true, nil
+		}
+	case markerInt:
+		size := uint64(1) << (marker & 0x0f)
+		if size > 16 {
+			break
+		}
+		p, err := d.bytes(offset+1, size)
+		if err != nil {
+			return nil, err
+		}
+		switch size {
+		case 16:
+			// 128 bits integers are used for unsigned values which don't fit int64
+			if v := binary.BigEndian.Uint64(p[8:]); v > math.MaxInt64 {
+				return v, nil
+			}
+			return int64(binary.BigEndian.Uint64(p[8:])), nil
+		case 8:
+			return int64(binary.BigEndian.Uint64(p)), nil
+		}
+		return int64(readUint(p, int(size))), nil
+	case markerDate & 0xf0:
+		if marker != markerDate {
+			break
+		}
+		p, err := d.bytes(offset+1, 8)
+		if err != nil {
+			return nil, err
+		}
+		seconds := math.Float64frombits(binary.BigEndian.Uint64(p))
+		if math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return nil, fmt.Errorf("%w [date at %d]", ErrBadObject, offset)
+		}
+		sec, frac := math.Modf(seconds)
+		return time.Unix(epoch.Unix()+int64(sec), int64(frac*float64(time.Second))).UTC(), nil
+	case markerReal:
+		switch marker & 0x0f {
+		case 2:
+			p, err := d.bytes(offset+1, 4)
+			if err != nil {
+				return nil, err
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(p))), nil
+		case 3:
+			p, err := d.bytes(offset+1, 8)
+			if err != nil {
+				return nil, err
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(p)), nil
+		}
+	case markerData, markerASCII, markerUnicode:
+		count, start, err := d.length(offset, marker)
+		if err != nil {
+			return nil, err
+		}
+		size := count
+		if marker&0xf0 == markerUnicode {
+			if count > uint64(len(d.data)) {
+				return nil, ErrTruncated
+			}
+			size = 2 * count
+		}
+		p, err := d.bytes(start, size)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := d.strings[ref]; ok {
+			return s, nil
+		}
+		// every reference to data gets its own copy, strings are copied once
+		if d.budget -= len(p); d.budget < 0 {
+			return nil, fmt.Errorf("%w [too much data]", ErrBadObject)
+		}
+		switch marker & 0xf0 {
+		case markerData:
+			return append([]byte{}, p...), nil
+		case markerASCII:
+			d.strings[ref] = string(p)
+		default:
+			units := make([]uint16, count)
+			for i := range units {
+				units[i] = binary.BigEndian.Uint16(p[2*i:])
+			}
+			d.strings[ref] = string(utf16.Decode(units))
+		}
+		return d.strings[ref], nil
+	case markerUID:
+		size := uint64(marker&0x0f) + 1
+		if size > 8 {
+			break
+		}
+		p, err := d.bytes(offset+1, size)
+		if err != nil {
+			return nil, err
+		}
+		return UID(readUint(p, int(size))), nil
+	case markerArray:
+		count, start, err := d.length(offset, marker)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := d.refs(start, count)
+		if err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, len(refs))
+		for i, ref := range refs {
+			if array[i], err = d.object(ref); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	case markerDict:
+		count, start, err := d.length(offset, marker)
+		if err != nil {
+			return nil, err
+		}
+		// keys are followed by values
+		if count > uint64(len(d.data)) {
+			return nil, ErrTruncated
+		}
+		refs, err := d.refs(start, 2*count)
+		if err != nil {
+			return nil, err
+		}
+		dict := make(map[string]interface{}, count)
+		for i := uint64(0); i < count; i++ {
+			key, err := d.object(refs[i])
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w [dict key %T]", ErrBadObject, key)
+			}
+			if dict[name], err = d.object(refs[count+i]); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("%w [marker 0x%02x]", ErrBadObject, marker)
+}
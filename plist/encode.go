@@ -0,0 +1,255 @@
+package plist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+	"unicode/utf16"
+)
+
+// encodedObject is the object which is prepared for encoding
+type encodedObject struct {
+	data []byte // encoded scalar object or marker with length of container
+	refs []int  // references of container items
+}
+
+// encoder is the state of encoding
+type encoder struct {
+	objects []encodedObject
+	unique  map[string]int // references of scalar objects by their encoding
+	depth   int
+}
+
+// Encode encodes the value as binary property list.
+// Dict keys are sorted, so the same value is always encoded to the same bytes.
+// Besides the types of Decode result, it accepts other integer types, float32 and []string
+func Encode(v interface{}) ([]byte, error) {
+	e := &encoder{unique: make(map[string]int)}
+	if _, err := e.add(v); err != nil {
+		return nil, err
+	}
+	refSize := uintSize(uint64(len(e.objects)))
+	// objects
+	data := []byte(magic)
+	offsets := make([]uint64, len(e.objects))
+	for i, o := range e.objects {
+		offsets[i] = uint64(len(data))
+		data = append(data, o.data...)
+		for _, ref := range o.refs {
+			data = appendUint(data, uint64(ref), refSize)
+		}
+	}
+	// offsets table
+	tableOffset := uint64(len(data))
+	offsetSize := uintSize(tableOffset)
+	for _, offset := range offsets {
+		data = appendUint(data, offset, offsetSize)
+	}
+	// trailer: 5 unused bytes, sort version, sizes, objects count, top object and offsets table
+	data = append(data, 0, 0, 0, 0, 0, 0, byte(offsetSize), byte(refSize))
+	data = appendUint(data, uint64(len(e.objects)), 8)
+	data = appendUint(data, 0, 8)
+	data = appendUint(data, tableOffset, 8)
+	return data, nil
+}
+
+// uintSize returns count of bytes (1, 2, 4 or 8) needed for the value
+func uintSize(v uint64) int {
+	switch {
+	case v <= math.MaxUint8:
+		return 1
+	case v <= math.MaxUint16:
+		return 2
+	case v <= math.MaxUint32:
+		return 4
+	}
+	return 8
+}
+
+// appendUint appends big-endian unsigned integer of the size
+func appendUint(p []byte, v uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		p = append(p, byte(v>>(8*uint(i))))
+	}
+	return p
+}
+
+// header returns marker of the object with the count of items
+func header(marker byte, count int) []byte {
+	if count < 15 {
+		return []byte{marker | byte(count)}
+	}
+	return append([]byte{marker | 0x0f}, encodeUint(uint64(count))...)
+}
+
+// encodeUint encodes unsigned integer object
+func encodeUint(v uint64) []byte {
+	if v > math.MaxInt64 {
+		// 128 bits integer
+		return appendUint(append([]byte{markerInt | 4}, make([]byte, 8)...), v, 8)
+	}
+	size := uintSize(v)
+	var width byte
+	for s := size; s > 1; s >>= 1 {
+		width++
+	}
+	return appendUint([]byte{markerInt | width}, v, size)
+}
+
+// encodeInt encodes signed integer object. Negative integers always take 8 bytes
+func encodeInt(v int64) []byte {
+	if v < 0 {
+		return appendUint([]byte{markerInt | 3}, uint64(v), 8)
+	}
+	return encodeUint(uint64(v))
+}
+
+// encodeString encodes ASCII string or UTF-16 string for other strings
+func encodeString(s string) []byte {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return append(header(markerASCII, len(s)), s...)
+	}
+	units := utf16.Encode([]rune(s))
+	data := header(markerUnicode, len(units))
+	for _, u := range units {
+		data = append(data, byte(u>>8), byte(u))
+	}
+	return data
+}
+
+// encodeScalar encodes the value which is not container
+func encodeScalar(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case nil:
+		return []byte{markerNull}, true
+	case bool:
+		if v {
+			return []byte{markerTrue}, true
+		}
+		return []byte{markerFalse}, true
+	case int:
+		return encodeInt(int64(v)), true
+	case int8:
+		return encodeInt(int64(v)), true
+	case int16:
+		return encodeInt(int64(v)), true
+	case int32:
+		return encodeInt(int64(v)), true
+	case int64:
+		return encodeInt(v), true
+	case uint:
+		return encodeUint(uint64(v)), true
+	case uint8:
+		return encodeUint(uint64(v)), true
+	case uint16:
+		return encodeUint(uint64(v)), true
+	case uint32:
+		return encodeUint(uint64(v)), true
+	case uint64:
+		return encodeUint(v), true
+	case float32:
+		data := make([]byte, 5)
+		data[0] = markerReal | 2
+		binary.BigEndian.PutUint32(data[1:], math.Float32bits(v))
+		return data, true
+	case float64:
+		data := make([]byte, 9)
+		data[0] = markerReal | 3
+		binary.BigEndian.PutUint64(data[1:], math.Float64bits(v))
+		return data, true
+	case time.Time:
+		seconds := float64(v.Unix()-epoch.Unix()) + float64(v.Nanosecond())/float64(time.Second)
+		data := make([]byte, 9)
+		data[0] = markerDate
+		binary.BigEndian.PutUint64(data[1:], math.Float64bits(seconds))
+		return data, true
+	case []byte:
+		return append(header(markerData, len(v)), v...), true
+	case string:
+		return encodeString(v), true
+	case UID:
+		size := uintSize(uint64(v))
+		return appendUint([]byte{markerUID | byte(size-1)}, uint64(v), size), true
+	}
+	return nil, false
+}
+
+// add adds the value and its items to objects and returns its reference.
+// Equal scalar objects are stored once the way Finder does
+func (e *encoder) add(v interface{}) (int, error) {
+	if data, ok := encodeScalar(v); ok {
+		if ref, ok := e.unique[string(data)]; ok {
+			return ref, nil
+		}
+		e.unique[string(data)] = len(e.objects)
+		e.objects = append(e.objects, encodedObject{data: data})
+		return len(e.objects) - 1, nil
+	}
+	if e.depth >= maxDepth {
+		return 0, fmt.Errorf("%w [too deep]", ErrBadObject)
+	}
+	e.depth++
+	defer func() {
+		e.depth--
+	}()
+	ref := len(e.objects)
+	e.objects = append(e.objects, encodedObject{})
+	o := encodedObject{}
+	switch v := v.(type) {
+	case []string:
+		o.data = header(markerArray, len(v))
+		for _, item := range v {
+			r, err := e.add(item)
+			if err != nil {
+				return 0, err
+			}
+			o.refs = append(o.refs, r)
+		}
+	case []interface{}:
+		o.data = header(markerArray, len(v))
+		for _, item := range v {
+			r, err := e.add(item)
+			if err != nil {
+				return 0, err
+			}
+			o.refs = append(o.refs, r)
+		}
+	case map[string]interface{}:
+		o.data = header(markerDict, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		// keys are followed by values
+		values := make([]int, 0, len(keys))
+		for _, key := range keys {
+			r, err := e.add(key)
+			if err != nil {
+				return 0, err
+			}
+			o.refs = append(o.refs, r)
+		}
+		for _, key := range keys {
+			r, err := e.add(v[key])
+			if err != nil {
+				return 0, err
+			}
+			values = append(values, r)
+		}
+		o.refs = append(o.refs, values...)
+	default:
+		return 0, fmt.Errorf("%w [%T]", ErrUnsupportedType, v)
+	}
+	e.objects[ref] = o
+	return ref, nil
+}
@@ -0,0 +1,65 @@
+// Package plist implements binary property list (bplist00) decoding and encoding.
+//
+// Property list objects are mapped to Go values:
+//   - dict: map[string]interface{}
+//   - array: []interface{}
+//   - string and UTF-16 string: string
+//   - int: int64 (uint64 for 16 bytes integers which don't fit int64)
+//   - real: float64
+//   - bool: bool
+//   - date: time.Time
+//   - data: []byte
+//   - UID: UID
+//   - null: nil
+package plist
+
+import (
+	"errors"
+	"time"
+)
+
+// UID is keyed archiver object reference
+type UID uint64
+
+// Decoding and encoding errors
+var (
+	ErrBadMagic        = errors.New("invalid bplist00 magic")
+	ErrTruncated       = errors.New("unexpected end of bplist00 data")
+	ErrBadObject       = errors.New("invalid bplist00 object")
+	ErrBadRef          = errors.New("invalid bplist00 object reference")
+	ErrCycle           = errors.New("bplist00 object contains itself")
+	ErrUnsupportedType = errors.New("unsupported type for bplist00")
+)
+
+// bplist00 magic and trailer size
+const (
+	magic       = "bplist00"
+	trailerSize = 32
+)
+
+// object markers
+const (
+	markerNull    = 0x00
+	markerFalse   = 0x08
+	markerTrue    = 0x09
+	markerInt     = 0x10
+	markerReal    = 0x20
+	markerDate    = 0x33
+	markerData    = 0x40
+	markerASCII   = 0x50
+	markerUnicode = 0x60
+	markerUID     = 0x80
+	markerArray   = 0xa0
+	markerDict    = 0xd0
+)
+
+// limits of decoding: nesting of containers, count of decoded objects
+// and copied data bytes relative to the input size
+const (
+	maxDepth     = 512
+	maxObjects   = 1 << 20
+	maxExpansion = 8
+)
+
+// epoch of dates: 2001-01-01
+var epoch = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
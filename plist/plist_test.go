@@ -0,0 +1,232 @@
+package plist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBlobs returns bplist00 blobs of .DS_Store records (length prefix is followed by the data)
+func testBlobs(t *testing.T) [][]byte {
+	data, err := ioutil.ReadFile(filepath.Join("..", "testdata", "00.DS_Store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := make([][]byte, 0)
+	for i := bytes.Index(data, []byte(magic)); i >= 4; {
+		size := int(binary.BigEndian.Uint32(data[i-4:]))
+		blobs = append(blobs, data[i:i+size])
+		next := bytes.Index(data[i+size:], []byte(magic))
+		if next < 0 {
+			break
+		}
+		i += size + next
+	}
+	return blobs
+}
+
+// checkLength checks that the trailer directly follows the offsets table
+func checkLength(t *testing.T, data []byte) bool {
+	trailer := data[len(data)-trailerSize:]
+	offsetSize := int(trailer[6])
+	count := int(binary.BigEndian.Uint64(trailer[8:]))
+	tableOffset := int(binary.BigEndian.Uint64(trailer[24:]))
+	if len(data) != tableOffset+count*offsetSize+trailerSize {
+		t.Errorf("Invalid bplist00 length %d, offsets table %d, objects %d, offset size %d", len(data), tableOffset, count, offsetSize)
+		return false
+	}
+	return true
+}
+
+func TestDecode(t *testing.T) {
+	blobs := testBlobs(t)
+	if len(blobs) == 0 {
+		t.Errorf("No bplist00 blobs")
+		return
+	}
+	for i, blob := range blobs {
+		if !checkLength(t, blob) {
+			return
+		}
+		v, err := Decode(blob)
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		if _, ok := v.(map[string]interface{}); !ok {
+			t.Errorf("Blob %d is not dict: %T", i, v)
+			return
+		}
+		// encoded value is decoded to the same value, encoding is deterministic
+		data, err := Encode(v)
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		if !checkLength(t, data) {
+			return
+		}
+		v2, err := Decode(data)
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		if !reflect.DeepEqual(v, v2) {
+			t.Errorf("Blob %d is different after encoding: %v != %v", i, v, v2)
+			return
+		}
+		data2, err := Encode(v2)
+		if err != nil {
+			t.Errorf("%s", err.Error())
+			return
+		}
+		if !bytes.Equal(data, data2) {
+			t.Errorf("Blob %d encoding is not deterministic", i)
+		}
+	}
+	// window settings
+	v, err := Decode(blobs[0])
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if bounds, ok := v.(map[string]interface{})["WindowBounds"].(string); !ok || len(bounds) == 0 {
+		t.Errorf("Invalid window bounds %v", v)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	long := make([]interface{}, 300)
+	for i := range long {
+		long[i] = int64(i * 1000)
+	}
+	value := map[string]interface{}{
+		"dict":    map[string]interface{}{"nested": true},
+		"array":   []interface{}{false, nil, "x"},
+		"long":    long,
+		"string":  "Applications",
+		"unicode": "Приложения ✓ 😀",
+		"int":     int64(-5),
+		"big":     uint64(math.MaxUint64),
+		"int16":   int64(0x1234),
+		"real":    1.5,
+		"date":    time.Date(2020, time.March, 1, 12, 30, 0, 500000000, time.UTC),
+		"old":     time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC),
+		"data":    bytes.Repeat([]byte{1, 2, 3}, 10),
+		"uid":     UID(0x10203),
+	}
+	data, err := Encode(value)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !checkLength(t, data) {
+		return
+	}
+	v, err := Decode(data)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(v, value) {
+		t.Errorf("Decoded value is different: %v != %v", v, value)
+	}
+	// other Go types
+	data, err = Encode([]interface{}{3, uint8(4), float32(0.5), []string{"a"}})
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	v, err = Decode(data)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(v, []interface{}{int64(3), int64(4), 0.5, []interface{}{"a"}}) {
+		t.Errorf("Decoded value is different: %v", v)
+	}
+	if _, err := Encode(struct{}{}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestDecodeMalicious(t *testing.T) {
+	data, err := Encode([]interface{}{"a", []interface{}{"b"}})
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	// objects: 0 array(a, array), 1 "a", 2 array(b), 3 "b"
+	cycle := append([]byte{}, data...)
+	cycle[bytes.IndexByte(cycle, 0xa1)+1] = 0
+	// top object is out of objects
+	top := append([]byte{}, data...)
+	top[len(top)-9] = 9
+	tests := []struct {
+		data []byte
+		err  error
+	}{
+		{data[:20], ErrTruncated},
+		{append([]byte("bplist01"), data[8:]...), ErrBadMagic},
+		{cycle, ErrCycle},
+		{top, ErrBadRef},
+	}
+	for i, test := range tests {
+		if _, err := Decode(test.data); !errors.Is(err, test.err) {
+			t.Errorf("Test %d: unexpected error %v, expected %v", i, err, test.err)
+		}
+	}
+}
+
+// sharedPlist returns bplist00 with the array of count references to one object of the marker with size bytes
+func sharedPlist(marker byte, size, count int) []byte {
+	data := []byte(magic)
+	// object 0: the shared object
+	data = append(data, marker|0x0f, markerInt|1, byte(size>>8), byte(size))
+	data = append(data, bytes.Repeat([]byte{'a'}, size)...)
+	// object 1: the array, all references are 0
+	arrayOffset := len(data)
+	data = append(data, markerArray|0x0f, markerInt|1, byte(count>>8), byte(count))
+	data = append(data, make([]byte, count)...)
+	tableOffset := len(data)
+	data = appendUint(data, uint64(len(magic)), 4)
+	data = appendUint(data, uint64(arrayOffset), 4)
+	data = append(data, 0, 0, 0, 0, 0, 0, 4, 1)
+	data = appendUint(data, 2, 8)
+	data = appendUint(data, 1, 8)
+	return appendUint(data, uint64(tableOffset), 8)
+}
+
+func TestDecodeShared(t *testing.T) {
+	// about 24 KB of input would be decoded to 40 MB of data copies
+	if _, err := Decode(sharedPlist(markerData, 4096, 20000)); !errors.Is(err, ErrBadObject) {
+		t.Errorf("Unexpected error %v", err)
+		return
+	}
+	// shared strings are decoded once
+	v, err := Decode(sharedPlist(markerASCII, 4096, 20000))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if array, ok := v.([]interface{}); !ok || len(array) != 20000 || array[19999] != strings.Repeat("a", 4096) {
+		t.Errorf("Invalid shared strings")
+		return
+	}
+	// shared data within the limit
+	v, err = Decode(sharedPlist(markerData, 4096, 4))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if array, ok := v.([]interface{}); !ok || len(array) != 4 || !bytes.Equal(array[3].([]byte), bytes.Repeat([]byte{'a'}, 4096)) {
+		t.Errorf("Invalid shared data")
+	}
+}
@@ -0,0 +1,168 @@
+package dsstore
+
+import (
+	"fmt"
+
+	"github.com/gwend/dsstore/plist"
+)
+
+// property maps plist key to the field of typed struct
+type property struct {
+	key       string
+	field     interface{} // pointer to the field: *bool, *int, *float64, *string, *[]byte or *Rect
+	omitEmpty bool        // zero value is not written
+}
+
+// propertyDict is typed struct which is mapped from plist dict. Unknown keys are kept in its Extra field
+type propertyDict interface {
+	fromDict(dict map[string]interface{}) error // takes the dict, known keys are removed from it
+	toDict() (map[string]interface{}, error)
+}
+
+// parseProperties moves values of the properties from the dict to the fields, the rest keys become extra
+func parseProperties(dict map[string]interface{}, properties []property, extra *map[string]interface{}) error {
+	for _, p := range properties {
+		value, ok := dict[p.key]
+		if !ok {
+			continue
+		}
+		if err := setField(p.field, value); err != nil {
+			return fmt.Errorf("invalid %s value: %w", p.key, err)
+		}
+		delete(dict, p.key)
+	}
+	*extra = dict
+	return nil
+}
+
+// encodeProperties returns plist dict with extra keys and values of the properties
+func encodeProperties(properties []property, extra map[string]interface{}) (map[string]interface{}, error) {
+	dict := copyDict(extra)
+	for _, p := range properties {
+		value, empty, err := fieldValue(p.field)
+		if err != nil {
+			return nil, err
+		}
+		if !empty || !p.omitEmpty {
+			dict[p.key] = value
+		}
+	}
+	return dict, nil
+}
+
+// setField sets the field by plist value. Real values of integer fields are truncated
+func setField(field interface{}, value interface{}) error {
+	var ok bool
+	switch f := field.(type) {
+	case *bool:
+		*f, ok = value.(bool)
+	case *string:
+		*f, ok = value.(string)
+	case *[]byte:
+		*f, ok = value.([]byte)
+	case *float64:
+		switch n := value.(type) {
+		case float64:
+			*f, ok = n, true
+		case int64:
+			*f, ok = float64(n), true
+		case uint64:
+			*f, ok = float64(n), true
+		}
+	case *int:
+		var n float64
+		if err := setField(&n, value); err != nil {
+			return err
+		}
+		*f, ok = int(n), true
+	case *Rect:
+		s, isString := value.(string)
+		if !isString {
+			break
+		}
+		r, err := ParseRect(s)
+		if err != nil {
+			return err
+		}
+		*f, ok = r, true
+	}
+	if !ok {
+		return fmt.Errorf("unexpected type %T", value)
+	}
+	return nil
+}
+
+// fieldValue returns plist value of the field and whether it is zero
+func fieldValue(field interface{}) (interface{}, bool, error) {
+	switch f := field.(type) {
+	case *bool:
+		return *f, !*f, nil
+	case *string:
+		return *f, *f == "", nil
+	case *[]byte:
+		return *f, *f == nil, nil
+	case *float64:
+		return *f, *f == 0, nil
+	case *int:
+		return int64(*f), *f == 0, nil
+	case *Rect:
+		return f.String(), *f == Rect{}, nil
+	}
+	return nil, false, fmt.Errorf("unsupported field type %T", field)
+}
+
+// decodePropertyDict decodes plist dict to the typed struct
+func decodePropertyDict(data []byte, p propertyDict) error {
+	v, err := plist.Decode(data)
+	if err != nil {
+		return err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid plist %T, dict is expected", v)
+	}
+	return p.fromDict(dict)
+}
+
+// encodePropertyDict encodes the typed struct to plist data
+func encodePropertyDict(p propertyDict) ([]byte, error) {
+	dict, err := p.toDict()
+	if err != nil {
+		return nil, err
+	}
+	return plist.Encode(dict)
+}
+
+// readProperties decodes plist dict of the blob record to the typed struct. It returns false if there is no record
+func (s *Store) readProperties(fileName string, code FourCC, p propertyDict) (bool, error) {
+	r, ok := s.Find(fileName, code)
+	if !ok {
+		return false, nil
+	}
+	if r.Type != TypeBlob {
+		return true, fmt.Errorf("invalid %s type %s", code, r.Type)
+	}
+	if err := decodePropertyDict(r.Data, p); err != nil {
+		return true, fmt.Errorf("%s: %w", code, err)
+	}
+	return true, nil
+}
+
+// writeProperties encodes the typed struct to the blob record
+func (s *Store) writeProperties(fileName string, code FourCC, p propertyDict) error {
+	data, err := encodePropertyDict(p)
+	if err != nil {
+		return err
+	}
+	s.Set(NewBlobRecord(fileName, code, data))
+	return nil
+}
+
+// copyDict returns shallow copy of the dict
+func copyDict(dict map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(dict))
+	for key, value := range dict {
+		c[key] = value
+	}
+	return c
+}
@@ -2,61 +2,54 @@ package dsstore
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-
-	"golang.org/x/text/encoding/unicode"
-	"golang.org/x/text/transform"
 )
 
 func (s *Store) readBlock(fileData []byte, offset, size uint32) *bytes.Buffer {
-	// check size
-	if offset+4+size > uint32(len(fileData)) {
+	// check size. 64 bit arithmetic doesn't overflow
+	if uint64(offset)+4+uint64(size) > uint64(len(fileData)) {
 		return nil
 	}
 	// alloc reading buffer
 	return bytes.NewBuffer(fileData[offset+4 : offset+4+size])
 }
 
-func (s *Store) readOffsets(b *bytes.Buffer) ([]uint32, error) {
+func readOffsets(b *bytes.Buffer) ([]uint32, error) {
 	var count uint32
-	if err := binary.Read(b, binary.BigEndian, &count); err != nil {
+	if err := readUint32(b, &count); err != nil {
 		return nil, err
 	}
 	// read dummy value
 	var value uint32
-	if err := binary.Read(b, binary.BigEndian, &value); err != nil {
+	if err := readUint32(b, &value); err != nil {
 		return nil, err
 	}
-	// read offsets
-	offsets := make([]uint32, 0)
-	for offcount := int(count); offcount > 0; offcount -= 256 {
-		for i := 0; i < 256; i++ {
-			if err := binary.Read(b, binary.BigEndian, &value); err != nil {
-				return nil, err
-			}
-			if value == 0 {
-				continue
-			}
-			offsets = append(offsets, value)
-		}
+	// offsets are stored by pages of 256 entries
+	if (uint64(count)+255)/256*256*4 > uint64(b.Len()) {
+		return nil, ErrTruncated
+	}
+	// read offsets keeping positions of empty entries
+	offsets := make([]uint32, (count+255)/256*256)
+	if err := readUint32s(b, offsets); err != nil {
+		return nil, err
 	}
-	// offsets
-	return offsets, nil
+	// offsets beyond the count are padding, they stay in the capacity for validation
+	return offsets[:count], nil
 }
 
-func (s *Store) readTopics(b *bytes.Buffer) (map[string]uint32, error) {
+func readTopics(b *bytes.Buffer) ([]Topic, error) {
 	// read topic count
 	var count uint32
-	if err := binary.Read(b, binary.BigEndian, &count); err != nil {
+	if err := readUint32(b, &count); err != nil {
 		return nil, err
 	}
 	// read topics
-	topics := make(map[string]uint32)
+	topics := make([]Topic, 0)
 	for i := count; i > 0; i-- {
 		// read topic len
 		len, err := b.ReadByte()
@@ -65,284 +58,505 @@ func (s *Store) readTopics(b *bytes.Buffer) (map[string]uint32, error) {
 		}
 		// read topic name
 		name := make([]byte, len)
-		_, err = b.Read(name)
-		if err != nil {
+		if _, err = io.ReadFull(b, name); err != nil {
 			return nil, err
 		}
 		// read topic index
 		var index uint32
-		if err := binary.Read(b, binary.BigEndian, &index); err != nil {
+		if err := readUint32(b, &index); err != nil {
 			return nil, err
 		}
 		// add topic
-		topics[string(name)] = index
+		topics = append(topics, Topic{Name: string(name), Index: index})
 	}
 	return topics, nil
 }
 
-func (s *Store) readFreeBlocks(b *bytes.Buffer) error {
+// findTopic returns block index of the topic
+func findTopic(topics []Topic, name string) (uint32, bool) {
+	for _, t := range topics {
+		if t.Name == name {
+			return t.Index, true
+		}
+	}
+	return 0, false
+}
+
+// readTopicBlocks reads raw blocks behind unknown topic.
+// B-tree nodes are collected if the topic block looks like B-tree header
+func (s *Store) readTopicBlocks(fileData []byte, offsets []uint32, index uint32) map[uint32][]byte {
+	blocks := make(map[uint32][]byte)
+	block := s.readTopicBlock(fileData, offsets, index, blocks)
+	if block == nil {
+		return blocks
+	}
+	h, err := readTreeHeader(block)
+	if err != nil {
+		return blocks
+	}
+	// walk B-tree nodes. damaged nodes are skipped
+	nodes := []uint32{h.root}
+	for i := 0; i < len(nodes) && i < len(offsets); i++ {
+		if _, ok := blocks[nodes[i]]; ok {
+			continue
+		}
+		blockData := s.readTopicBlock(fileData, offsets, nodes[i], blocks)
+		if blockData == nil {
+			continue
+		}
+		var nextNode, count uint32
+		if readUint32(blockData, &nextNode) != nil || readUint32(blockData, &count) != nil || nextNode == 0 {
+			continue
+		}
+		nodes = append(nodes, nextNode)
+		for k := 0; k < int(count); k++ {
+			var childNode uint32
+			if readUint32(blockData, &childNode) != nil {
+				break
+			}
+			nodes = append(nodes, childNode)
+			if _, err := readParseFile(blockData); err != nil {
+				break
+			}
+		}
+	}
+	return blocks
+}
+
+// readTopicBlock keeps raw data of the block and returns it for parsing
+func (s *Store) readTopicBlock(fileData []byte, offsets []uint32, index uint32, blocks map[uint32][]byte) *bytes.Buffer {
+	if int(index) >= len(offsets) || offsets[index] == 0 {
+		return nil
+	}
+	offset := offsets[index]
+	b := s.readBlock(fileData, blockOffset(offset), blockSize(offset))
+	if b == nil {
+		return nil
+	}
+	blocks[index] = append([]byte{}, b.Bytes()...)
+	return b
+}
+
+func readFreeBlocks(b *bytes.Buffer) ([][]uint32, error) {
+	freeBlocks := make([][]uint32, 32)
 	for i := 0; i < 32; i++ {
 		var count uint32
-		if err := binary.Read(b, binary.BigEndian, &count); err != nil {
-			return err
+		if err := readUint32(b, &count); err != nil {
+			return nil, err
 		}
 		if count == 0 {
 			continue
 		}
+		if uint64(count)*4 > uint64(b.Len()) {
+			return nil, ErrTruncated
+		}
 		for k := 0; k < int(count); k++ {
 			var value uint32
-			if err := binary.Read(b, binary.BigEndian, &value); err != nil {
-				return err
+			if err := readUint32(b, &value); err != nil {
+				return nil, err
 			}
+			freeBlocks[i] = append(freeBlocks[i], value)
 		}
 	}
-	return nil
+	return freeBlocks, nil
 }
 
-func (s *Store) readParseFile(b *bytes.Buffer) (Record, error) {
+func readParseFile(b *bytes.Buffer) (Record, error) {
 	r := Record{}
 	// len
 	var len uint32
-	if err := binary.Read(b, binary.BigEndian, &len); err != nil {
+	if err := readUint32(b, &len); err != nil {
 		return r, err
 	}
-	// name
-	name16 := make([]byte, 2*len)
-	if _, err := b.Read(name16); err != nil {
+	// name. check size before allocation
+	if 2*uint64(len) > uint64(b.Len()) {
+		return r, ErrTruncated
+	}
+	name16, err := readBytes(b, 2*int(len))
+	if err != nil {
 		return r, err
 	}
 	// extra
-	if err := binary.Read(b, binary.BigEndian, &r.Extra); err != nil {
+	if err := readUint32(b, &r.Extra); err != nil {
 		return r, err
 	}
 	// type
-	stype := make([]byte, 4)
-	if _, err := b.Read(stype); err != nil {
+	stype, err := readBytes(b, 4)
+	if err != nil {
 		return r, err
 	}
 	r.Type = string(stype)
 
-	byteToRead := -1
-	// read data
-	switch {
-	case r.Type == "bool":
-		byteToRead = 1
-		break
-	case r.Type == "type" || r.Type == "long" || r.Type == "shor":
-		byteToRead = 4
-		break
-	case r.Type == "comp" || r.Type == "dutc":
-		byteToRead = 8
-		break
-	case r.Type == "blob":
-		if err := binary.Read(b, binary.BigEndian, &r.DataLen); err != nil {
+	// read data. length prefix depends on type only
+	byteToRead, err := valueSize(r.Type)
+	if err != nil {
+		return r, err
+	}
+	if byteToRead < 0 {
+		if err := readUint32(b, &r.DataLen); err != nil {
 			return r, err
 		}
-		byteToRead = int(r.DataLen)
-		break
-	case r.Type == "ustr":
-		if err := binary.Read(b, binary.BigEndian, &r.DataLen); err != nil {
-			return r, err
+		size := uint64(r.DataLen)
+		if r.Type == TypeString {
+			size = 2 * uint64(r.DataLen)
 		}
-		byteToRead = int(2 * r.DataLen)
-	default:
-		break
-	}
-	if byteToRead <= 0 {
-		return r, fmt.Errorf("unknown record format [%s]", r.Type)
-	}
-	r.Data = make([]byte, byteToRead)
-	if _, err := b.Read(r.Data); err != nil {
-		return r, err
+		// check size before allocation
+		if size > uint64(b.Len()) {
+			return r, ErrTruncated
+		}
+		byteToRead = int(size)
 	}
-	name, _, err := transform.Bytes(unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM).NewDecoder(), name16)
+	data, err := readBytes(b, byteToRead)
 	if err != nil {
 		return r, err
 	}
-	r.FileName = string(name)
+	r.Data = append(make([]byte, 0, byteToRead), data...)
+	r.FileName = decodeUTF16(name16)
 	return r, nil
 }
 
-func (s *Store) readParseData(fileData []byte, offsets []uint32, node uint32) error {
+func (s *Store) readParseData(fileData []byte, offsets []uint32, node uint32, st *readState, depth int) (*layoutNode, error) {
 	// check node
-	if int(node) >= len(offsets) {
-		return errors.New("invalid data block")
+	if int(node) >= len(offsets) || offsets[node] == 0 {
+		return nil, newParseError(StageNode, int(node), -1, ErrBadBlock)
 	}
+	// protect against cycles and too deep trees
+	if st.visited[node] {
+		return nil, newParseError(StageNode, int(node), -1, ErrCycle)
+	}
+	if depth >= maxTreeDepth {
+		return nil, newParseError(StageNode, int(node), -1, ErrTooDeep)
+	}
+	if st.options.MaxDepth > 0 && depth >= st.options.MaxDepth {
+		return nil, newParseError(StageNode, int(node), -1, fmt.Errorf("%w [tree depth %d]", ErrLimitExceeded, st.options.MaxDepth))
+	}
+	// stop reading of cancelled context
+	if err := st.ctx.Err(); err != nil {
+		return nil, err
+	}
+	st.visited[node] = true
 	// prepare data block
 	offset := offsets[node]
-	blockData := s.readBlock(fileData, blockOffset(offset), blockSize(offset))
+	start, size := blockOffset(offset), blockSize(offset)
+	blockData := s.readBlock(fileData, start, size)
 	if blockData == nil {
-		return errors.New("invalid data block")
+		return nil, newParseError(StageNode, int(node), int64(start)+4, ErrBadBlock)
 	}
+	n := &layoutNode{index: node, offset: offset}
 
 	var nextNode uint32
-	if err := binary.Read(blockData, binary.BigEndian, &nextNode); err != nil {
-		return err
+	if err := readUint32(blockData, &nextNode); err != nil {
+		return nil, newParseError(StageNode, int(node), blockPosition(start, size, blockData), err)
 	}
 	var count uint32
-	if err := binary.Read(blockData, binary.BigEndian, &count); err != nil {
-		return err
+	if err := readUint32(blockData, &count); err != nil {
+		return nil, newParseError(StageNode, int(node), blockPosition(start, size, blockData), err)
 	}
+	n.count = int(count)
 
 	if nextNode > 0 {
 		for i := 0; i < int(count); i++ {
 			var childNode uint32
-			if err := binary.Read(blockData, binary.BigEndian, &childNode); err != nil {
-				return err
+			if err := readUint32(blockData, &childNode); err != nil {
+				err = newParseError(StageNode, int(node), blockPosition(start, size, blockData), err)
+				if err = s.readWarning(st, err); err != nil {
+					return nil, err
+				}
+				break
 			}
-			if err := s.readParseData(fileData, offsets, childNode); err != nil {
-				return err
+			child, err := s.readParseData(fileData, offsets, childNode, st, depth+1)
+			if err = s.readWarning(st, err); err != nil {
+				return nil, err
 			}
+			n.children = append(n.children, child)
 			// get the file for the current block
-			r, err := s.readParseFile(blockData)
+			position := blockPosition(start, size, blockData)
+			r, err := readParseFile(blockData)
 			if err != nil {
-				return err
+				if err = s.readWarning(st, newParseError(StageRecord, int(node), position, err)); err != nil {
+					return nil, err
+				}
+				break
+			}
+			if err := st.checkRecord(r, len(s.Records)); err != nil {
+				return nil, newParseError(StageRecord, int(node), position, err)
 			}
 			s.Records = append(s.Records, r)
 		}
-		err := s.readParseData(fileData, offsets, nextNode)
-		if err != nil {
-			return err
+		// the last child can be read even if the records of the node are damaged
+		child, err := s.readParseData(fileData, offsets, nextNode, st, depth+1)
+		if err = s.readWarning(st, err); err != nil {
+			return nil, err
 		}
+		n.children = append(n.children, child)
 	} else {
 		for i := 0; i < int(count); i++ {
-			r, err := s.readParseFile(blockData)
+			position := blockPosition(start, size, blockData)
+			r, err := readParseFile(blockData)
 			if err != nil {
-				return err
+				if err = s.readWarning(st, newParseError(StageRecord, int(node), position, err)); err != nil {
+					return nil, err
+				}
+				break
+			}
+			if err := st.checkRecord(r, len(s.Records)); err != nil {
+				return nil, newParseError(StageRecord, int(node), position, err)
 			}
 			s.Records = append(s.Records, r)
 		}
 	}
-	return nil
+	n.size = int(size) - blockData.Len()
+	return n, nil
+}
+
+// treeHeader is B-tree header stored in DSDB block
+type treeHeader struct {
+	root     uint32 // index of root node
+	levels   uint32 // levels of internal nodes
+	records  uint32 // count of records
+	nodes    uint32 // count of nodes
+	pageSize uint32 // node page size
+}
+
+func readTreeHeader(b *bytes.Buffer) (treeHeader, error) {
+	var h treeHeader
+	values := []*uint32{&h.root, &h.levels, &h.records, &h.nodes, &h.pageSize}
+	for _, v := range values {
+		if err := readUint32(b, v); err != nil {
+			return h, err
+		}
+	}
+	if h.pageSize != nodePageSize {
+		return h, ErrBadTree
+	}
+	return h, nil
 }
 
-func (s *Store) readParseDSDB(fileData []byte, offsets []uint32, topics map[string]uint32) error {
+func (s *Store) readParseDSDB(fileData []byte, offsets []uint32, topics []Topic, st *readState) error {
 	// find node by topic and check it
-	node := topics["DSDB"]
-	if int(node) >= len(offsets) {
-		return errors.New("invalid DSDB block")
+	node, ok := findTopic(topics, "DSDB")
+	if !ok || int(node) >= len(offsets) || offsets[node] == 0 {
+		return newParseError(StageDSDB, int(node), -1, ErrBadTree)
 	}
 	// find topic block
 	offset := offsets[node]
-	blockDSDB := s.readBlock(fileData, blockOffset(offset), blockSize(offset))
+	start, size := blockOffset(offset), blockSize(offset)
+	blockDSDB := s.readBlock(fileData, start, size)
 	if blockDSDB == nil {
-		return errors.New("invalid DSDB block")
+		return newParseError(StageDSDB, int(node), int64(start)+4, ErrBadBlock)
 	}
-	// read data root node
-	var dataRoot uint32
-	err := binary.Read(blockDSDB, binary.BigEndian, &dataRoot)
+	// read B-tree header
+	h, err := readTreeHeader(blockDSDB)
 	if err != nil {
-		return err
-	}
-	// just reading
-	var levels uint32
-	if err = binary.Read(blockDSDB, binary.BigEndian, &levels); err != nil {
-		return err
-	}
-	var records uint32
-	if err = binary.Read(blockDSDB, binary.BigEndian, &records); err != nil {
-		return err
-	}
-	var nodes uint32
-	if err = binary.Read(blockDSDB, binary.BigEndian, &nodes); err != nil {
-		return err
-	}
-	var dummy uint32
-	if err = binary.Read(blockDSDB, binary.BigEndian, &dummy); err != nil {
-		return err
-	}
-	if dummy != 0x1000 {
-		return errors.New("invalid DSDB block")
+		return newParseError(StageDSDB, int(node), int64(start)+4, err)
 	}
 	// read extra
 	if s.DSDBExtra, err = ioutil.ReadAll(blockDSDB); err != nil {
 		return err
 	}
+	s.layout.offsetDSDB = offset
+	s.layout.root = h.root
+	s.layout.levels = h.levels
+	s.layout.nodes = h.nodes
 	// parse data
-	return s.readParseData(fileData, offsets, dataRoot)
+	s.layout.tree, err = s.readParseData(fileData, offsets, h.root, st, 0)
+	return s.readWarning(st, err)
 }
 
-func (s *Store) readParseRoot(fileData []byte, offset, size uint32) error {
+func (s *Store) readParseRoot(fileData []byte, offset, size uint32, st *readState) error {
 	blockRoot := s.readBlock(fileData, offset, size)
 	if blockRoot == nil {
-		return errors.New("invalid root block")
+		return newParseError(StageRoot, -1, int64(offset)+4, ErrBadBlock)
 	}
 	// read offsets
-	offsets, err := s.readOffsets(blockRoot)
+	offsets, err := readOffsets(blockRoot)
 	if err != nil {
-		return err
+		return newParseError(StageRoot, -1, blockPosition(offset, size, blockRoot), err)
 	}
 	// read topics
-	topics, err := s.readTopics(blockRoot)
+	topics, err := readTopics(blockRoot)
 	if err != nil {
-		return err
+		return newParseError(StageRoot, -1, blockPosition(offset, size, blockRoot), err)
 	}
 	// parse free blocks
-	if err = s.readFreeBlocks(blockRoot); err != nil {
-		return err
+	if s.layout.freeBlocks, err = readFreeBlocks(blockRoot); err != nil {
+		return newParseError(StageRoot, -1, blockPosition(offset, size, blockRoot), err)
 	}
+	s.layout.rootHead = fileData[offset+4 : offset+4+size-uint32(blockRoot.Len())]
 	// read extra root data
 	if s.RootExtra, err = ioutil.ReadAll(blockRoot); err != nil {
 		return err
 	}
+	// keep blocks of unknown topics
+	for _, t := range topics {
+		if t.Name != "DSDB" {
+			t.Blocks = s.readTopicBlocks(fileData, offsets, t.Index)
+		}
+		s.Topics = append(s.Topics, t)
+	}
+	s.layout.topics = copyTopics(s.Topics)
 	// parse DSDB
-	return s.readParseDSDB(fileData, offsets, topics)
+	return s.readParseDSDB(fileData, offsets, topics, st)
+}
+
+// readHeader reads file header and returns offset and size of root block
+func readHeader(b *bytes.Buffer) (uint32, uint32, error) {
+	var headerMagic, headerOffset1, headerSize, headerOffset2 uint32
+	// magic 1
+	if err := readUint32(b, &headerMagic); err != nil {
+		return 0, 0, err
+	}
+	if headerMagic != headerMagic1 {
+		return 0, 0, ErrBadMagic
+	}
+	// magic 2
+	if err := readUint32(b, &headerMagic); err != nil {
+		return 0, 0, err
+	}
+	if headerMagic != headerMagic2 {
+		return 0, 0, ErrBadMagic
+	}
+	// offset1
+	if err := readUint32(b, &headerOffset1); err != nil {
+		return 0, 0, err
+	}
+	// size
+	if err := readUint32(b, &headerSize); err != nil {
+		return 0, 0, err
+	}
+	// offset2
+	if err := readUint32(b, &headerOffset2); err != nil {
+		return 0, 0, err
+	}
+	if headerOffset1 != headerOffset2 {
+		return 0, 0, ErrBadHeader
+	}
+	return headerOffset1, headerSize, nil
+}
+
+// ReadOptions are options of reading
+type ReadOptions struct {
+	// Lenient mode skips damaged B-tree nodes and records instead of failing.
+	// Skipped parts are reported in Store.Warnings, all readable records are returned.
+	// Header, root block and DSDB block are required in lenient mode too.
+	Lenient bool
+
+	// Limits of the data. Zero value means no limit.
+	// Exceeded limit fails reading with ErrLimitExceeded even in lenient mode.
+	MaxInputSize  int64 // size of input data in bytes
+	MaxRecords    int   // count of records
+	MaxBlobSize   int   // size of record data in bytes (blob and ustr)
+	MaxDepth      int   // depth of B-tree, 1 for the tree of one node
+	MaxNameLength int   // length of file name in UTF-16 code units
+}
+
+// readState is the state of reading
+type readState struct {
+	ctx     context.Context
+	options ReadOptions
+	visited map[uint32]bool // visited B-tree nodes
+}
+
+// checkRecord checks the record and the count of records read before it by the limits
+func (st *readState) checkRecord(r Record, count int) error {
+	o := st.options
+	if o.MaxRecords > 0 && count >= o.MaxRecords {
+		return fmt.Errorf("%w [records count %d]", ErrLimitExceeded, o.MaxRecords)
+	}
+	if o.MaxBlobSize > 0 && len(r.Data) > o.MaxBlobSize {
+		return fmt.Errorf("%w [data size %d]", ErrLimitExceeded, o.MaxBlobSize)
+	}
+	if o.MaxNameLength > 0 && lengthUTF16(r.FileName) > o.MaxNameLength {
+		return fmt.Errorf("%w [name length %d]", ErrLimitExceeded, o.MaxNameLength)
+	}
+	return nil
+}
+
+// contextReader stops reading when the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// readWarning returns the error or collects it as warning in lenient mode.
+// Exceeded limits and cancelled context are always returned
+func (s *Store) readWarning(st *readState, err error) error {
+	if err == nil || !st.options.Lenient || errors.Is(err, ErrLimitExceeded) || st.ctx.Err() != nil {
+		return err
+	}
+	s.Warnings = append(s.Warnings, err)
+	return nil
 }
 
 // Read reads .DS_Store from io.Reader
 func (s *Store) Read(r io.Reader) error {
+	return s.ReadWithOptions(r, ReadOptions{})
+}
+
+// ReadWithOptions reads .DS_Store from io.Reader with the options
+func (s *Store) ReadWithOptions(r io.Reader, options ReadOptions) error {
+	return s.ReadContext(context.Background(), r, options)
+}
+
+// ReadContext reads .DS_Store from io.Reader with the options.
+// Reading stops with the context error when the context is done
+func (s *Store) ReadContext(ctx context.Context, r io.Reader, options ReadOptions) error {
 	// clear
 	s.HeaderExtra = nil
 	s.RootExtra = nil
 	s.DSDBExtra = nil
 	s.Records = nil
+	s.Topics = nil
+	s.Warnings = nil
+	s.layout = nil
+	st := &readState{ctx: ctx, options: options, visited: make(map[uint32]bool)}
 	// read all
+	r = &contextReader{ctx: ctx, r: r}
+	if options.MaxInputSize > 0 {
+		r = io.LimitReader(r, options.MaxInputSize+1)
+	}
 	fileData, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
+	if options.MaxInputSize > 0 && int64(len(fileData)) > options.MaxInputSize {
+		return fmt.Errorf("%w [input size %d]", ErrLimitExceeded, options.MaxInputSize)
+	}
+	l := &layout{data: fileData}
 	// file size
 	fileSize := len(fileData)
 	if fileSize < 36 {
-		return errors.New("invalid file header")
+		return newParseError(StageHeader, -1, 0, ErrTruncated)
 	}
 	blockHeader := bytes.NewBuffer(fileData[:36])
-	var headerMagic, headerOffset1, headerSize, headerOffset2 uint32
-	// magic 1
-	if err := binary.Read(blockHeader, binary.BigEndian, &headerMagic); err != nil {
-		return err
-	}
-	if headerMagic != headerMagic1 {
-		return errors.New("invalid first magic")
-	}
-	// magic 2
-	if err := binary.Read(blockHeader, binary.BigEndian, &headerMagic); err != nil {
-		return err
-	}
-	if headerMagic != headerMagic2 {
-		return errors.New("invalid second magic")
-	}
-	// offset1
-	if err := binary.Read(blockHeader, binary.BigEndian, &headerOffset1); err != nil {
-		return err
-	}
-	// size
-	if err := binary.Read(blockHeader, binary.BigEndian, &headerSize); err != nil {
-		return err
-	}
-	// offset2
-	if err := binary.Read(blockHeader, binary.BigEndian, &headerOffset2); err != nil {
-		return err
-	}
-	if headerOffset1 != headerOffset2 {
-		return errors.New("invalid header offset")
+	headerOffset, headerSize, err := readHeader(blockHeader)
+	if err != nil {
+		return newParseError(StageHeader, -1, int64(36-blockHeader.Len()-4), err)
 	}
 	// read header extra
 	if s.HeaderExtra, err = ioutil.ReadAll(blockHeader); err != nil {
 		return err
 	}
 	// parse root (bookkeeping) block
-	return s.readParseRoot(fileData, headerOffset1, headerSize)
+	l.offsetRoot = headerOffset
+	l.sizeRoot = headerSize
+	s.layout = l
+	if err = s.readParseRoot(fileData, headerOffset, headerSize, st); err != nil {
+		s.layout = nil
+		return err
+	}
+	// layout of damaged file can't be preserved
+	if len(s.Warnings) > 0 {
+		s.layout = nil
+	}
+	return nil
 }
 
 // ReadFile reads .DS_Store from the file
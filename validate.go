@@ -0,0 +1,372 @@
+package dsstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Severity of validation finding
+type Severity int
+
+// Severities of validation findings
+const (
+	SeverityWarning Severity = iota // unusual structure which is readable
+	SeverityError                   // broken structure
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Finding is structural inconsistency found by Validate
+type Finding struct {
+	Severity   Severity
+	BlockIndex int    // index of the block in offsets table, -1 when it is not related to a block
+	Offset     int64  // byte offset in the file, -1 when it is unknown
+	Message    string // description
+}
+
+func (f Finding) String() string {
+	if f.BlockIndex < 0 {
+		return fmt.Sprintf("%s at offset %d: %s", f.Severity, f.Offset, f.Message)
+	}
+	return fmt.Sprintf("%s (block %d) at offset %d: %s", f.Severity, f.BlockIndex, f.Offset, f.Message)
+}
+
+// validator collects findings of Validate
+type validator struct {
+	data      []byte
+	findings  []Finding
+	offsets   []uint32       // offsets table including empty entries
+	reachable map[int]bool   // indices of reachable blocks
+	positions map[int64]bool // file offsets of B-tree records
+	records   int            // count of records in B-tree
+	nodes     int            // count of nodes in B-tree
+	leafDepth int            // depth of the first leaf, -1 before it is found
+	last      *Record        // previous record in B-tree order
+}
+
+func (v *validator) add(severity Severity, index int, offset int64, format string, args ...interface{}) {
+	v.findings = append(v.findings, Finding{severity, index, offset, fmt.Sprintf(format, args...)})
+}
+
+// Validate checks structure of .DS_Store data and returns all found inconsistencies:
+// header, block offsets, free blocks, topics and DSDB B-tree.
+// It doesn't stop at the first error, the result is empty for structurally sound data
+func Validate(data []byte) []Finding {
+	v := newValidator(data)
+	v.validate()
+	return v.findings
+}
+
+func newValidator(data []byte) *validator {
+	return &validator{data: data, reachable: make(map[int]bool), positions: make(map[int64]bool), leafDepth: -1}
+}
+
+func (v *validator) validate() {
+	data := v.data
+	// header
+	if len(data) < 36 {
+		v.add(SeverityError, -1, 0, "file is shorter than header")
+		return
+	}
+	if binary.BigEndian.Uint32(data) != headerMagic1 || binary.BigEndian.Uint32(data[4:]) != headerMagic2 {
+		v.add(SeverityError, -1, 0, "invalid magic")
+		return
+	}
+	rootOffset := binary.BigEndian.Uint32(data[8:])
+	rootSize := binary.BigEndian.Uint32(data[12:])
+	if offset2 := binary.BigEndian.Uint32(data[16:]); offset2 != rootOffset {
+		v.add(SeverityError, -1, 16, "header root offsets are different: %#x != %#x", rootOffset, offset2)
+	}
+	if uint64(rootOffset)+4+uint64(rootSize) > uint64(len(data)) {
+		v.add(SeverityError, -1, 8, "root block is out of the file")
+		return
+	}
+	// root block
+	blockRoot := bytes.NewBuffer(data[rootOffset+4 : rootOffset+4+rootSize])
+	var err error
+	if v.offsets, err = readOffsets(blockRoot); err != nil {
+		v.add(SeverityError, -1, blockPosition(rootOffset, rootSize, blockRoot), "invalid offsets table: %s", err.Error())
+		return
+	}
+	v.checkPadding()
+	topics, err := readTopics(blockRoot)
+	if err != nil {
+		v.add(SeverityError, -1, blockPosition(rootOffset, rootSize, blockRoot), "invalid topics: %s", err.Error())
+		return
+	}
+	freeBlocks, err := readFreeBlocks(blockRoot)
+	if err != nil {
+		v.add(SeverityError, -1, blockPosition(rootOffset, rootSize, blockRoot), "invalid free blocks: %s", err.Error())
+		freeBlocks = nil
+	}
+	// blocks
+	rootIndex := v.checkBlocks(rootOffset, rootSize)
+	if rootIndex >= 0 {
+		v.reachable[rootIndex] = true
+	}
+	v.checkFreeBlocks(freeBlocks)
+	// topics
+	if _, ok := findTopic(topics, "DSDB"); !ok {
+		v.add(SeverityError, -1, -1, "DSDB topic is not found")
+	}
+	for _, t := range topics {
+		index := int(t.Index)
+		if !v.validIndex(index) {
+			v.add(SeverityError, index, -1, "block of topic %s is not found", t.Name)
+			continue
+		}
+		v.reachable[index] = true
+		if t.Name == "DSDB" {
+			v.checkTree(index)
+		} else {
+			v.markTopicTree(index)
+		}
+	}
+	// unreachable blocks
+	for i, offset := range v.offsets {
+		if offset != 0 && !v.reachable[i] {
+			v.add(SeverityWarning, i, int64(blockOffset(offset))+4, "block is unreachable")
+		}
+	}
+}
+
+func (v *validator) validIndex(index int) bool {
+	return index >= 0 && index < len(v.offsets) && v.offsets[index] != 0
+}
+
+// checkPadding checks that entries of the last offsets page beyond offsets count are empty
+func (v *validator) checkPadding() {
+	padding := v.offsets[len(v.offsets):cap(v.offsets)]
+	for i, offset := range padding {
+		if offset != 0 {
+			v.add(SeverityWarning, len(v.offsets)+i, -1, "offset is out of offsets count")
+		}
+	}
+}
+
+// checkBlocks checks ranges of used blocks and returns index of the root block
+func (v *validator) checkBlocks(rootOffset, rootSize uint32) int {
+	rootIndex := -1
+	used := make([]int, 0)
+	for i, offset := range v.offsets {
+		if offset == 0 {
+			continue
+		}
+		start, size := blockOffset(offset), blockSize(offset)
+		position := int64(start) + 4
+		if start == rootOffset {
+			rootIndex = i
+			if rootSize > size {
+				v.add(SeverityError, i, position, "root block size %d is bigger than block size %d", rootSize, size)
+			}
+		}
+		if size < 32 {
+			v.add(SeverityWarning, i, position, "block size %d is less than 32", size)
+		}
+		if start%size != 0 {
+			v.add(SeverityWarning, i, position, "block is not aligned to its size %d", size)
+		}
+		if start < 32 {
+			v.add(SeverityError, i, position, "block overlaps header")
+		}
+		if uint64(start)+4+uint64(size) > uint64(len(v.data)) {
+			v.add(SeverityError, i, position, "block is out of the file")
+		}
+		used = append(used, i)
+	}
+	if rootIndex < 0 {
+		v.add(SeverityError, -1, 8, "root block %#x is not found in offsets table", rootOffset)
+	}
+	// overlapping blocks
+	sort.SliceStable(used, func(i, j int) bool {
+		return blockOffset(v.offsets[used[i]]) < blockOffset(v.offsets[used[j]])
+	})
+	for i := 1; i < len(used); i++ {
+		prev, cur := v.offsets[used[i-1]], v.offsets[used[i]]
+		if uint64(blockOffset(prev))+uint64(blockSize(prev)) > uint64(blockOffset(cur)) {
+			v.add(SeverityError, used[i], int64(blockOffset(cur))+4, "block overlaps block %d", used[i-1])
+		}
+	}
+	return rootIndex
+}
+
+// checkFreeBlocks checks free blocks against used blocks and each other
+func (v *validator) checkFreeBlocks(freeBlocks [][]uint32) {
+	type span struct {
+		start, end uint64
+		free       bool
+	}
+	spans := make([]span, 0)
+	for _, offset := range v.offsets {
+		if offset != 0 {
+			spans = append(spans, span{uint64(blockOffset(offset)), uint64(blockOffset(offset)) + uint64(blockSize(offset)), false})
+		}
+	}
+	for i, offsets := range freeBlocks {
+		size := uint64(1) << uint(i)
+		for _, offset := range offsets {
+			if uint64(offset)%size != 0 {
+				v.add(SeverityWarning, -1, int64(offset)+4, "free block is not aligned to its size %d", size)
+			}
+			if offset < 32 {
+				v.add(SeverityError, -1, int64(offset)+4, "free block overlaps header")
+			}
+			spans = append(spans, span{uint64(offset), uint64(offset) + size, true})
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	var end uint64
+	var endFree bool
+	for i, sp := range spans {
+		if i > 0 && sp.start < end && (sp.free || endFree) {
+			if sp.free && endFree {
+				v.add(SeverityError, -1, int64(sp.start)+4, "free blocks overlap")
+			} else {
+				v.add(SeverityError, -1, int64(sp.start)+4, "free block overlaps used block")
+			}
+		}
+		if sp.end > end {
+			end, endFree = sp.end, sp.free
+		}
+	}
+}
+
+// checkTree checks DSDB block and its B-tree
+func (v *validator) checkTree(index int) {
+	offset := v.offsets[index]
+	start, size := blockOffset(offset), blockSize(offset)
+	if uint64(start)+4+uint64(size) > uint64(len(v.data)) {
+		return
+	}
+	h, err := readTreeHeader(bytes.NewBuffer(v.data[start+4 : start+4+size]))
+	if err != nil {
+		v.add(SeverityError, index, int64(start)+4, "invalid DSDB block: %s", err.Error())
+		return
+	}
+	v.checkNode(int(h.root), 0)
+	if uint32(v.records) != h.records {
+		v.add(SeverityError, index, int64(start)+12, "DSDB records count %d doesn't match B-tree records count %d", h.records, v.records)
+	}
+	if uint32(v.nodes) != h.nodes {
+		v.add(SeverityError, index, int64(start)+16, "DSDB nodes count %d doesn't match B-tree nodes count %d", h.nodes, v.nodes)
+	}
+	if v.leafDepth >= 0 && uint32(v.leafDepth) != h.levels {
+		v.add(SeverityError, index, int64(start)+8, "DSDB levels %d doesn't match B-tree levels %d", h.levels, v.leafDepth)
+	}
+}
+
+// markTopicTree marks nodes of unknown topic B-tree as reachable the way reader keeps them.
+// The format of unknown records is not known, so the nodes are not checked
+func (v *validator) markTopicTree(index int) {
+	h, err := readTreeHeader(v.blockData(index))
+	if err != nil {
+		return
+	}
+	nodes := []uint32{h.root}
+	for i := 0; i < len(nodes) && i < len(v.offsets); i++ {
+		node := int(nodes[i])
+		if !v.validIndex(node) || v.reachable[node] {
+			continue
+		}
+		v.reachable[node] = true
+		b := v.blockData(node)
+		var next, count uint32
+		if readUint32(b, &next) != nil || readUint32(b, &count) != nil || next == 0 {
+			continue
+		}
+		nodes = append(nodes, next)
+		for k := 0; k < int(count); k++ {
+			var child uint32
+			if readUint32(b, &child) != nil {
+				break
+			}
+			nodes = append(nodes, child)
+			if _, err := readParseFile(b); err != nil {
+				break
+			}
+		}
+	}
+}
+
+// blockData returns data of the block, it is empty for blocks out of the file
+func (v *validator) blockData(index int) *bytes.Buffer {
+	offset := v.offsets[index]
+	start, size := blockOffset(offset), blockSize(offset)
+	if uint64(start)+4+uint64(size) > uint64(len(v.data)) {
+		return bytes.NewBuffer(nil)
+	}
+	return bytes.NewBuffer(v.data[start+4 : start+4+size])
+}
+
+// checkNode checks B-tree node and its children
+func (v *validator) checkNode(index int, depth int) {
+	if !v.validIndex(index) {
+		v.add(SeverityError, index, -1, "B-tree node is not found")
+		return
+	}
+	offset := v.offsets[index]
+	start, size := blockOffset(offset), blockSize(offset)
+	if v.reachable[index] {
+		v.add(SeverityError, index, int64(start)+4, "block is referenced twice")
+		return
+	}
+	v.reachable[index] = true
+	if depth >= maxTreeDepth {
+		v.add(SeverityError, index, int64(start)+4, "B-tree is too deep")
+		return
+	}
+	if uint64(start)+4+uint64(size) > uint64(len(v.data)) {
+		return
+	}
+	v.nodes++
+	b := bytes.NewBuffer(v.data[start+4 : start+4+size])
+	var next, count uint32
+	if readUint32(b, &next) != nil || readUint32(b, &count) != nil {
+		v.add(SeverityError, index, int64(start)+4, "invalid B-tree node")
+		return
+	}
+	if next == 0 && v.leafDepth < 0 {
+		v.leafDepth = depth
+	} else if next == 0 && v.leafDepth != depth {
+		v.add(SeverityError, index, int64(start)+4, "leaf depth %d is different from depth %d of other leaves", depth, v.leafDepth)
+	}
+	for i := 0; i < int(count); i++ {
+		if next != 0 {
+			var child uint32
+			if err := readUint32(b, &child); err != nil {
+				v.add(SeverityError, index, blockPosition(start, size, b), "invalid B-tree node")
+				return
+			}
+			v.checkNode(int(child), depth+1)
+		}
+		position := blockPosition(start, size, b)
+		r, err := readParseFile(b)
+		if err != nil {
+			v.add(SeverityError, index, position, "invalid record: %s", err.Error())
+			return
+		}
+		v.checkRecord(index, position, r)
+	}
+	if next != 0 {
+		v.checkNode(int(next), depth+1)
+	}
+}
+
+// checkRecord checks order of records
+func (v *validator) checkRecord(index int, position int64, r Record) {
+	v.records++
+	v.positions[position] = true
+	if v.last != nil && CompareRecords(*v.last, r) >= 0 {
+		v.add(SeverityError, index, position, "record %s %s is not sorted after %s %s", r.FileName, r.Code(), v.last.FileName, v.last.Code())
+	}
+	v.last = &r
+}
@@ -0,0 +1,196 @@
+package dsstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Record data types
+const (
+	TypeBool   = "bool" // boolean, 1 byte
+	TypeLong   = "long" // 4 bytes integer
+	TypeShort  = "shor" // 2 bytes integer stored in 4 bytes
+	TypeFourCC = "type" // four-character code
+	TypeComp   = "comp" // 8 bytes integer
+	TypeDate   = "dutc" // timestamp, 1/65536 second intervals since 1904
+	TypeString = "ustr" // UTF-16 string with length prefix
+	TypeBlob   = "blob" // raw bytes with length prefix
+)
+
+// FourCC is four-character code stored as big-endian 4 bytes
+type FourCC uint32
+
+// String returns four-character code as string
+func (c FourCC) String() string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(c))
+	return string(b)
+}
+
+// Mac epoch for dutc values
+var macEpoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// macEpochUnix is Mac epoch in Unix seconds
+var macEpochUnix = macEpoch.Unix()
+
+// maxDateSeconds limits seconds of dutc values, they have 48 bits
+const maxDateSeconds = 1<<48 - 1
+
+// valueSize returns data size of fixed size types or -1 for types with length prefix
+func valueSize(t string) (int, error) {
+	switch t {
+	case TypeBool:
+		return 1, nil
+	case TypeLong, TypeShort, TypeFourCC:
+		return 4, nil
+	case TypeComp, TypeDate:
+		return 8, nil
+	case TypeString, TypeBlob:
+		return -1, nil
+	}
+	return 0, fmt.Errorf("%w [%s]", ErrUnknownType, t)
+}
+
+// check checks that Data and DataLen are consistent with Type
+func (r Record) check() error {
+	size, err := valueSize(r.Type)
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.Type == TypeBlob:
+		if int(r.DataLen) != len(r.Data) {
+			return fmt.Errorf("invalid data size of [%s] record", r.Type)
+		}
+	case r.Type == TypeString:
+		if 2*int(r.DataLen) != len(r.Data) {
+			return fmt.Errorf("invalid data size of [%s] record", r.Type)
+		}
+	default:
+		if r.DataLen != 0 || len(r.Data) != size {
+			return fmt.Errorf("invalid data size of [%s] record", r.Type)
+		}
+	}
+	return nil
+}
+
+// Value decodes Data by Type.
+// It returns bool, int32 (long), int16 (shor), FourCC (type), uint64 (comp),
+// time.Time (dutc), string (ustr) or []byte (blob)
+func (r Record) Value() (interface{}, error) {
+	if err := r.check(); err != nil {
+		return nil, err
+	}
+	switch r.Type {
+	case TypeBool:
+		return r.Data[0] != 0, nil
+	case TypeLong:
+		return int32(binary.BigEndian.Uint32(r.Data)), nil
+	case TypeShort:
+		return int16(binary.BigEndian.Uint32(r.Data)), nil
+	case TypeFourCC:
+		return FourCC(binary.BigEndian.Uint32(r.Data)), nil
+	case TypeComp:
+		return binary.BigEndian.Uint64(r.Data), nil
+	case TypeDate:
+		v := binary.BigEndian.Uint64(r.Data)
+		nsec := int64(v&0xffff) * int64(time.Second) / 0x10000
+		return time.Unix(int64(v>>16)+macEpochUnix, nsec).UTC(), nil
+	case TypeString:
+		return decodeUTF16(r.Data), nil
+	}
+	return r.Data, nil
+}
+
+// SetValue sets Type, Data and DataLen by Go value.
+// Supported values are bool, int32, int16, FourCC, uint64, time.Time, string and []byte
+func (r *Record) SetValue(value interface{}) error {
+	switch v := value.(type) {
+	case bool:
+		r.Type, r.DataLen, r.Data = TypeBool, 0, []byte{0}
+		if v {
+			r.Data[0] = 1
+		}
+	case int32:
+		r.Type, r.DataLen, r.Data = TypeLong, 0, make([]byte, 4)
+		binary.BigEndian.PutUint32(r.Data, uint32(v))
+	case int16:
+		r.Type, r.DataLen, r.Data = TypeShort, 0, make([]byte, 4)
+		binary.BigEndian.PutUint32(r.Data, uint32(int32(v)))
+	case FourCC:
+		r.Type, r.DataLen, r.Data = TypeFourCC, 0, make([]byte, 4)
+		binary.BigEndian.PutUint32(r.Data, uint32(v))
+	case uint64:
+		r.Type, r.DataLen, r.Data = TypeComp, 0, make([]byte, 8)
+		binary.BigEndian.PutUint64(r.Data, v)
+	case time.Time:
+		secs := v.Unix() - macEpochUnix
+		if secs < 0 || secs > maxDateSeconds {
+			return fmt.Errorf("time %s is out of dutc range", v)
+		}
+		frac := uint64(v.Nanosecond()) * 0x10000 / uint64(time.Second)
+		r.Type, r.DataLen, r.Data = TypeDate, 0, make([]byte, 8)
+		binary.BigEndian.PutUint64(r.Data, uint64(secs)<<16|frac)
+	case string:
+		r.Data = encodeUTF16(v)
+		r.Type, r.DataLen = TypeString, uint32(len(r.Data)/2)
+	case []byte:
+		r.Type, r.DataLen, r.Data = TypeBlob, uint32(len(v)), append([]byte{}, v...)
+	default:
+		return errors.New("unsupported value type")
+	}
+	return nil
+}
+
+func newRecord(fileName string, code FourCC, value interface{}) Record {
+	r := Record{FileName: fileName, Extra: uint32(code)}
+	// the value types are checked by callers, their values are always valid
+	_ = r.SetValue(value)
+	return r
+}
+
+// NewBoolRecord creates bool record
+func NewBoolRecord(fileName string, code FourCC, value bool) Record {
+	return newRecord(fileName, code, value)
+}
+
+// NewLongRecord creates long record
+func NewLongRecord(fileName string, code FourCC, value int32) Record {
+	return newRecord(fileName, code, value)
+}
+
+// NewShortRecord creates shor record
+func NewShortRecord(fileName string, code FourCC, value int16) Record {
+	return newRecord(fileName, code, value)
+}
+
+// NewFourCCRecord creates type record
+func NewFourCCRecord(fileName string, code FourCC, value FourCC) Record {
+	return newRecord(fileName, code, value)
+}
+
+// NewCompRecord creates comp record
+func NewCompRecord(fileName string, code FourCC, value uint64) Record {
+	return newRecord(fileName, code, value)
+}
+
+// NewDateRecord creates dutc record. It returns the error for time before 1904
+func NewDateRecord(fileName string, code FourCC, value time.Time) (Record, error) {
+	r := Record{FileName: fileName, Extra: uint32(code)}
+	if err := r.SetValue(value); err != nil {
+		return Record{}, err
+	}
+	return r, nil
+}
+
+// NewStringRecord creates ustr record
+func NewStringRecord(fileName string, code FourCC, value string) Record {
+	return newRecord(fileName, code, value)
+}
+
+// NewBlobRecord creates blob record
+func NewBlobRecord(fileName string, code FourCC, value []byte) Record {
+	return newRecord(fileName, code, value)
+}
@@ -0,0 +1,94 @@
+package dsstore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rect is the window rectangle. Finder stores it as "{{x, y}, {width, height}}" string
+type Rect struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+// ParseRect parses "{{x, y}, {width, height}}" string
+func ParseRect(s string) (Rect, error) {
+	var r Rect
+	var rest string
+	compact := strings.Replace(s, " ", "", -1)
+	n, _ := fmt.Sscanf(compact, "{{%d,%d},{%d,%d}}%s", &r.X, &r.Y, &r.Width, &r.Height, &rest)
+	if n != 4 || !strings.HasSuffix(compact, "}}") {
+		return Rect{}, fmt.Errorf("invalid rectangle %q", s)
+	}
+	return r, nil
+}
+
+// String formats the rectangle the way Finder does
+func (r Rect) String() string {
+	return fmt.Sprintf("{{%d, %d}, {%d, %d}}", r.X, r.Y, r.Width, r.Height)
+}
+
+// WindowSettings are browser window settings of the folder (bwsp record).
+// Keys which Finder added after these fields, like SidebarWidthTenElevenOrLater, stay in Extra
+type WindowSettings struct {
+	WindowBounds          Rect // window position and size, zero rectangle is not written
+	ShowStatusBar         bool
+	ShowToolbar           bool
+	ShowSidebar           bool
+	ShowPathbar           bool
+	ShowTabView           bool
+	ContainerShowSidebar  bool
+	SidebarWidth          int // zero width is not written
+	PreviewPaneVisibility bool
+
+	Extra map[string]interface{} // unknown keys, they are written back as they are
+}
+
+// properties maps bwsp keys to the fields
+func (w *WindowSettings) properties() []property {
+	return []property{
+		{"WindowBounds", &w.WindowBounds, true},
+		{"ShowStatusBar", &w.ShowStatusBar, false},
+		{"ShowToolbar", &w.ShowToolbar, false},
+		{"ShowSidebar", &w.ShowSidebar, false},
+		{"ShowPathbar", &w.ShowPathbar, false},
+		{"ShowTabView", &w.ShowTabView, false},
+		{"ContainerShowSidebar", &w.ContainerShowSidebar, false},
+		{"SidebarWidth", &w.SidebarWidth, true},
+		{"PreviewPaneVisibility", &w.PreviewPaneVisibility, false},
+	}
+}
+
+func (w *WindowSettings) fromDict(dict map[string]interface{}) error {
+	return parseProperties(dict, w.properties(), &w.Extra)
+}
+
+func (w *WindowSettings) toDict() (map[string]interface{}, error) {
+	return encodeProperties(w.properties(), w.Extra)
+}
+
+// ParseWindowSettings decodes bwsp plist
+func ParseWindowSettings(data []byte) (WindowSettings, error) {
+	var w WindowSettings
+	err := decodePropertyDict(data, &w)
+	return w, err
+}
+
+// Bytes encodes window settings to bwsp plist
+func (w WindowSettings) Bytes() ([]byte, error) {
+	return encodePropertyDict(&w)
+}
+
+// WindowSettings returns window settings of the folder. It returns false if there is no bwsp record
+func (s *Store) WindowSettings() (WindowSettings, bool, error) {
+	var w WindowSettings
+	ok, err := s.readProperties(".", CodeBwsp, &w)
+	return w, ok, err
+}
+
+// SetWindowSettings sets window settings of the folder
+func (s *Store) SetWindowSettings(w WindowSettings) error {
+	return s.writeProperties(".", CodeBwsp, &w)
+}
@@ -2,170 +2,263 @@ package dsstore
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"sort"
-
-	"golang.org/x/text/encoding/unicode"
-	"golang.org/x/text/transform"
 )
 
-type freeBlock struct {
-	offset uint32
-	size   uint32
+func (s *Store) writeRecord(b *bytes.Buffer, r Record) error {
+	// check data of the record
+	if err := r.check(); err != nil {
+		return err
+	}
+	// r.FileName
+	n := encodeUTF16(r.FileName)
+	if err := writeUint32(b, uint32(len(n)/2)); err != nil {
+		return err
+	}
+	if _, err := b.Write(n); err != nil {
+		return err
+	}
+	// unknown extra 4 bytes
+	if err := writeUint32(b, uint32(r.Extra)); err != nil {
+		return err
+	}
+	// r.Type (4-bytes string)
+	var t [4]byte
+	copy(t[:], r.Type)
+	if _, err := b.Write(t[:]); err != nil {
+		return err
+	}
+	// r.DataLen for blob, ustr etc
+	if size, _ := valueSize(r.Type); size < 0 {
+		if err := writeUint32(b, uint32(r.DataLen)); err != nil {
+			return err
+		}
+	}
+	// r.Data
+	if _, err := b.Write(r.Data); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeTreeNode is B-tree node prepared for writing
+type writeTreeNode struct {
+	index    uint32           // block index
+	items    [][]byte         // encoded records
+	children []*writeTreeNode // child nodes (internal nodes only), len(items)+1
 }
 
-func (s *Store) writeFreeMapCreate() []freeBlock {
-	freeBlocks := make([]freeBlock, 0)
-	for i := 5; i < 31; i++ {
-		pow := uint32(1 << i)
-		freeBlocks = append(freeBlocks, freeBlock{pow, pow})
+// writeSplitPages splits items with the given sizes into pages of a node.
+// It returns positions of items which have to be moved up between neighbour pages.
+// A page exceeds nodePageSize only if its item is bigger than the page or no cuts can make room for the last item
+func (s *Store) writeSplitPages(sizes []int, overhead int) []int {
+	cuts := make([]int, 0)
+	used := 8
+	start := 0 // the first item of the current page
+	for i := 0; i < len(sizes); i++ {
+		if i > start && used+overhead+sizes[i] > int(nodePageSize) {
+			if i+1 < len(sizes) {
+				// item i becomes separator between pages
+				cuts = append(cuts, i)
+				used = 8
+				start = i + 1
+				continue
+			}
+			if i-start > 1 {
+				// last item does not fit. previous item becomes separator
+				cuts = append(cuts, i-1)
+				break
+			}
+			// the page has one item only. previous pages give one item each, so it becomes separator
+			if shifted, ok := s.writeShiftCuts(cuts, sizes, overhead, i-1); ok {
+				cuts = shifted
+				break
+			}
+		}
+		used += overhead + sizes[i]
 	}
-	return freeBlocks
+	return cuts
 }
 
-func (s *Store) writeFreeMapSort(freeBlocks []freeBlock) {
-	sort.SliceStable(freeBlocks, func(i, j int) bool {
-		if freeBlocks[i].size < freeBlocks[j].size {
-			return true
+// writeShiftCuts moves the last cuts one item left until a page with more than one item gives its last item,
+// and adds the cut before the last item. It returns false if there is no such page or pages don't fit
+func (s *Store) writeShiftCuts(cuts []int, sizes []int, overhead int, last int) ([]int, bool) {
+	shifted := append(append([]int{}, cuts...), last)
+	for j := len(cuts) - 1; j >= 0; j-- {
+		shifted[j]--
+		prev := -1
+		if j > 0 {
+			prev = shifted[j-1]
 		}
-		if freeBlocks[i].size < freeBlocks[j].size {
-			return freeBlocks[i].offset < freeBlocks[j].offset
+		if shifted[j] > prev+1 {
+			return shifted, s.writePagesFit(shifted, sizes, overhead)
 		}
-		return false
-	})
+	}
+	return nil, false
 }
 
-func (s *Store) writeFreeMapAlloc(freeBlocks []freeBlock, size uint32, capacity uint32) (uint32, []freeBlock) {
-	// check capacity
-	if capacity < size {
-		capacity = size
-	}
-	// calculate size needed size that powered by 2
-	var powCapacity uint32 = 0
-	var powSize uint32 = 0
-	var powIndex uint32 = 32
-	for i := uint32(5); i < 32; i++ {
-		powCapacity = uint32(1) << i
-		if powCapacity >= size && powIndex >= 32 {
-			powIndex = i
-			powSize = powCapacity
-		}
-		if powCapacity >= capacity {
-			if powIndex < 32 {
-				break
-			}
+// writePagesFit reports whether all pages between the cuts fit nodePageSize
+func (s *Store) writePagesFit(cuts []int, sizes []int, overhead int) bool {
+	start := 0
+	for _, cut := range append(cuts, len(sizes)) {
+		used := 8
+		for i := start; i < cut; i++ {
+			used += overhead + sizes[i]
 		}
+		if used > int(nodePageSize) && cut-start > 1 {
+			return false
+		}
+		start = cut + 1
 	}
-	// sort map
-	s.writeFreeMapSort(freeBlocks)
-	// find block in partly used blocks
-	for i, block := range freeBlocks {
-		if block.size != block.offset && block.size == powCapacity {
-			freeBlocks = append(freeBlocks[:i], freeBlocks[i+1:]...)
-			if block.size > powSize {
-				freeBlocks = append(freeBlocks, freeBlock{block.offset + powSize, block.size - powSize})
+	return true
+}
+
+// writeTree builds balanced B-tree from encoded records.
+// It returns root node, count of internal levels and count of nodes.
+func (s *Store) writeTree(records [][]byte) (*writeTreeNode, uint32, uint32) {
+	// leaves
+	level := make([]*writeTreeNode, 0)
+	separators := make([][]byte, 0)
+	sizes := make([]int, len(records))
+	for i, r := range records {
+		sizes[i] = len(r)
+	}
+	start := 0
+	for _, cut := range append(s.writeSplitPages(sizes, 0), len(records)) {
+		level = append(level, &writeTreeNode{items: records[start:cut]})
+		if cut < len(records) {
+			separators = append(separators, records[cut])
+		}
+		start = cut + 1
+	}
+	nodes := uint32(len(level))
+	// internal nodes. each item of internal node has 4 bytes of child index
+	var levels uint32
+	for len(level) > 1 {
+		items := separators
+		sizes = make([]int, len(items))
+		for i, r := range items {
+			sizes[i] = len(r)
+		}
+		upper := make([]*writeTreeNode, 0)
+		separators = make([][]byte, 0)
+		start = 0
+		for _, cut := range append(s.writeSplitPages(sizes, 4), len(items)) {
+			upper = append(upper, &writeTreeNode{items: items[start:cut], children: level[start : cut+1]})
+			if cut < len(items) {
+				separators = append(separators, items[cut])
 			}
-			return block.offset | powIndex, freeBlocks
+			start = cut + 1
 		}
+		level = upper
+		nodes += uint32(len(level))
+		levels++
 	}
-	// find block in fully cleared blocks
-	for i, block := range freeBlocks {
-		if block.size >= powCapacity {
-			freeBlocks = append(freeBlocks[:i], freeBlocks[i+1:]...)
-			if block.size > powSize {
-				freeBlocks = append(freeBlocks, freeBlock{block.offset + powSize, block.size - powSize})
-			}
-			return block.offset | powIndex, freeBlocks
+	return level[0], levels, nodes
+}
+
+// writeTreeIndex assigns block indices to nodes starting from the root and returns nodes in index order
+func (s *Store) writeTreeIndex(root *writeTreeNode, indices []uint32) []*writeTreeNode {
+	nodes := []*writeTreeNode{root}
+	for i := 0; i < len(nodes); i++ {
+		nodes[i].index = indices[i]
+		nodes = append(nodes, nodes[i].children...)
+	}
+	return nodes
+}
+
+// writeTopicBlocks returns raw blocks of unknown topics by their indices
+func (s *Store) writeTopicBlocks() map[uint32][]byte {
+	blocks := make(map[uint32][]byte)
+	for _, t := range s.Topics {
+		if t.Name == "DSDB" {
+			continue
+		}
+		for index, data := range t.Blocks {
+			blocks[index] = data
 		}
 	}
-	return 0, freeBlocks
+	return blocks
 }
 
-func (s *Store) writeAlignBlock(b *bytes.Buffer, minSize uint32) error {
-	var len uint32 = uint32(b.Len())
-	for i := 0; i < 32; i++ {
-		var aligned uint32 = 1 << i
-		if len <= aligned && minSize <= aligned {
-			// add dummy bytes
-			if _, err := b.Write(make([]byte, aligned-len)); err != nil {
-				return err
-			}
-			break
+// writeReserved returns block indices of unknown topics: their blocks and their own indices.
+// Index of the topic without blocks is reserved too, so B-tree nodes don't take it
+func (s *Store) writeReserved(blocks map[uint32][]byte) map[uint32]bool {
+	reserved := make(map[uint32]bool)
+	for index := range blocks {
+		reserved[index] = true
+	}
+	for _, t := range s.Topics {
+		if t.Name != "DSDB" {
+			reserved[t.Index] = true
 		}
 	}
-	return nil
+	return reserved
+}
+
+// writeIndices returns count of the lowest block indices which are not reserved by topics
+func (s *Store) writeIndices(reserved map[uint32]bool, count int) []uint32 {
+	indices := make([]uint32, 0, count)
+	for index := uint32(0); len(indices) < count; index++ {
+		if !reserved[index] {
+			indices = append(indices, index)
+		}
+	}
+	return indices
 }
 
-func (s *Store) writeBlockData(b *bytes.Buffer, records []Record) error {
-	// nextBlock is always 0. Storing all records in the one block
-	if err := binary.Write(b, binary.BigEndian, uint32(0)); err != nil {
+func (s *Store) writeBlockNode(b *bytes.Buffer, n *writeTreeNode) error {
+	// right-most child for internal nodes, 0 for leaves
+	var next uint32
+	if len(n.children) > 0 {
+		next = n.children[len(n.children)-1].index
+	}
+	if err := writeUint32(b, next); err != nil {
 		return err
 	}
 	// count of records
-	if err := binary.Write(b, binary.BigEndian, uint32(len(records))); err != nil {
+	if err := writeUint32(b, uint32(len(n.items))); err != nil {
 		return err
 	}
 	// records
-	for _, r := range records {
-		// r.FileName
-		n, _, err := transform.Bytes(unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM).NewEncoder(), []byte(r.FileName))
-		if err != nil {
-			return err
-		}
-		if err := binary.Write(b, binary.BigEndian, uint32(len(n)/2)); err != nil {
-			return err
-		}
-		if _, err := b.Write(n); err != nil {
-			return err
-		}
-		// unknown extra 4 bytes
-		if err := binary.Write(b, binary.BigEndian, uint32(r.Extra)); err != nil {
-			return err
-		}
-		// r.Type (4-bytes string)
-		t := make([]byte, 4)
-		copy(t, []byte(r.Type))
-		if _, err := b.Write(t); err != nil {
-			return err
-		}
-		// r.DataLen for blob, ustr etc
-		if r.DataLen > 0 {
-			if err := binary.Write(b, binary.BigEndian, uint32(r.DataLen)); err != nil {
+	for i, item := range n.items {
+		// left child of the record
+		if len(n.children) > 0 {
+			if err := writeUint32(b, n.children[i].index); err != nil {
 				return err
 			}
 		}
-		// r.Data
-		if _, err := b.Write(r.Data); err != nil {
+		if _, err := b.Write(item); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (s *Store) writeBlockDSDB(b *bytes.Buffer, index uint32) error {
+func (s *Store) writeBlockDSDB(b *bytes.Buffer, index, levels, nodes uint32) error {
 	// write data block index
-	err := binary.Write(b, binary.BigEndian, index)
+	err := writeUint32(b, index)
 	if err != nil {
 		return err
 	}
-	// levels. always is 0
-	if err = binary.Write(b, binary.BigEndian, uint32(0)); err != nil {
+	// levels of internal nodes
+	if err = writeUint32(b, levels); err != nil {
 		return err
 	}
 	// records
-	if err = binary.Write(b, binary.BigEndian, uint32(len(s.Records))); err != nil {
+	if err = writeUint32(b, uint32(len(s.Records))); err != nil {
 		return err
 	}
-	// nodes. always is 1 (storing all data in one data block)
-	if err = binary.Write(b, binary.BigEndian, uint32(1)); err != nil {
+	// nodes
+	if err = writeUint32(b, nodes); err != nil {
 		return err
 	}
-	// dummy 0x1000 value
-	if err = binary.Write(b, binary.BigEndian, uint32(0x1000)); err != nil {
+	// page size
+	if err = writeUint32(b, nodePageSize); err != nil {
 		return err
 	}
 	// other unknown data
@@ -175,116 +268,84 @@ func (s *Store) writeBlockDSDB(b *bytes.Buffer, index uint32) error {
 	return nil
 }
 
-func (s *Store) writeOffsets(b *bytes.Buffer, offsetRoot, offsetDBDS, offsetData uint32) error {
-	// count of offset. always 3 blocks only
-	if err := binary.Write(b, binary.BigEndian, uint32(3)); err != nil {
+func (s *Store) writeOffsets(b *bytes.Buffer, offsets []uint32) error {
+	// count of offsets
+	if err := writeUint32(b, uint32(len(offsets))); err != nil {
 		return err
 	}
 	// dummy 4 bytes
-	if err := binary.Write(b, binary.BigEndian, uint32(0)); err != nil {
+	if err := writeUint32(b, uint32(0)); err != nil {
 		return err
 	}
 	// offsets
-	if err := binary.Write(b, binary.BigEndian, offsetRoot); err != nil {
-		return err
-	}
-	if err := binary.Write(b, binary.BigEndian, offsetDBDS); err != nil {
-		return err
-	}
-	if err := binary.Write(b, binary.BigEndian, offsetData); err != nil {
-		return err
+	for _, offset := range offsets {
+		if err := writeUint32(b, offset); err != nil {
+			return err
+		}
 	}
-	// dummy 253 zero offsets
-	for i := 0; i < 253; i++ {
-		if err := binary.Write(b, binary.BigEndian, uint32(0)); err != nil {
+	// dummy zero offsets up to the end of the 256 entries page
+	for i := len(offsets); i%256 != 0; i++ {
+		if err := writeUint32(b, uint32(0)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (s *Store) writeTopicDBDS(b *bytes.Buffer, index uint32) error {
-	// always one topic (DBDS)
-	if err := binary.Write(b, binary.BigEndian, uint32(1)); err != nil {
-		return err
-	}
-	// topic name len. Always is 4
-	if err := b.WriteByte(4); err != nil {
-		return err
-	}
-	// topic name
-	if _, err := b.Write([]byte("DSDB")); err != nil {
-		return err
+func (s *Store) writeTopics(b *bytes.Buffer, index uint32) error {
+	// DSDB topic is required
+	topics := s.Topics
+	if _, ok := findTopic(topics, "DSDB"); !ok {
+		topics = append([]Topic{{Name: "DSDB"}}, topics...)
 	}
-	// topic offset
-	if err := binary.Write(b, binary.BigEndian, uint32(index)); err != nil {
+	// count of topics
+	if err := writeUint32(b, uint32(len(topics))); err != nil {
 		return err
 	}
-	return nil
-}
-
-func (s *Store) writeFreeBlocks(b *bytes.Buffer, freeBlocks []freeBlock) error {
-	// sort blocks by size
-	s.writeFreeMapSort(freeBlocks)
-	// it is magic
-	for i := 0; i < 32; i++ {
-		// current block size (iterating block sizes 1, 2, 4, 8, 16, ..., 1024, 2048, 4096, ...)
-		var blockSize uint32 = uint32(1) << i
-		var blockCount uint32 = 0
-		for j := 0; j < len(freeBlocks); j++ {
-			power := (freeBlocks[j].size & (freeBlocks[j].size - 1)) == 0
-			// we need take blocks with size == blockSize
-			// but also we take all blocks bigger than blockSize that are not round by 2 power
-			//
-			// For example we have the following blocks allocation (globally 2 blocks - 2048-4096, 4096-8092):
-			// |             |####1024####                 |
-			// 2048          4096                          8092
-			//
-			// Used space is 4096-5120. Free space are 2048-4095 and 5121-8091 (sub part of block 4096-8092).
-			// Free blocks for blockSize == 2048 are 2048-4096 and 5120-8092 (because it can't be assinged to blocks with size >= 4096)
-			// Free blocks for blockSize == 4096 are none
-			// here we just calculate count of free blocks with needed size
-			if freeBlocks[j].size == blockSize || (freeBlocks[j].size > blockSize && !power) {
-				blockCount++
-				continue
-			}
-			if freeBlocks[j].size >= blockSize {
-				break
-			}
+	for _, t := range topics {
+		// topic name len
+		if len(t.Name) > 255 {
+			return errors.New("too long topic name")
 		}
-		if err := binary.Write(b, binary.BigEndian, uint32(blockCount)); err != nil {
+		if err := b.WriteByte(byte(len(t.Name))); err != nil {
 			return err
 		}
-		if blockCount > 0 {
-			// writing blocks offsets
-			for j := 0; j < len(freeBlocks); j++ {
-				power := (freeBlocks[j].size & (freeBlocks[j].size - 1)) == 0
-				if freeBlocks[j].size == blockSize || (freeBlocks[j].size > blockSize && !power) {
-					if err := binary.Write(b, binary.BigEndian, uint32(freeBlocks[j].offset)); err != nil {
-						return err
-					}
-					continue
-				}
-				if freeBlocks[j].size >= blockSize {
-					break
-				}
-			}
+		// topic name
+		if _, err := b.Write([]byte(t.Name)); err != nil {
+			return err
+		}
+		// topic block index. DSDB block is written by the writer
+		topicIndex := t.Index
+		if t.Name == "DSDB" {
+			topicIndex = index
+		}
+		if err := writeUint32(b, topicIndex); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (s *Store) writeBlockRoot(b *bytes.Buffer, offsetRoot, offsetDBDS, offsetData uint32, freeBlocks []freeBlock) error {
+func (s *Store) writeFreeBlocks(b *bytes.Buffer, a *Allocator) error {
+	data, err := a.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = b.Write(data)
+	return err
+}
+
+func (s *Store) writeBlockRoot(b *bytes.Buffer, offsets []uint32, indexDSDB uint32, a *Allocator) error {
 	// offsets
-	if err := s.writeOffsets(b, offsetRoot, offsetDBDS, offsetData); err != nil {
+	if err := s.writeOffsets(b, offsets); err != nil {
 		return err
 	}
-	// topic. index is always 1
-	if err := s.writeTopicDBDS(b, 1); err != nil {
+	// topics
+	if err := s.writeTopics(b, indexDSDB); err != nil {
 		return err
 	}
 	// free blocks
-	if err := s.writeFreeBlocks(b, freeBlocks); err != nil {
+	if err := s.writeFreeBlocks(b, a); err != nil {
 		return err
 	}
 	// write extra (unknown data)
@@ -296,23 +357,23 @@ func (s *Store) writeBlockRoot(b *bytes.Buffer, offsetRoot, offsetDBDS, offsetDa
 
 func (s *Store) writeHeader(b *bytes.Buffer, offsetRoot, size uint32) error {
 	// magic1
-	if err := binary.Write(b, binary.BigEndian, headerMagic1); err != nil {
+	if err := writeUint32(b, headerMagic1); err != nil {
 		return err
 	}
 	// magic2
-	if err := binary.Write(b, binary.BigEndian, headerMagic2); err != nil {
+	if err := writeUint32(b, headerMagic2); err != nil {
 		return err
 	}
 	// offset of root block
-	if err := binary.Write(b, binary.BigEndian, offsetRoot); err != nil {
+	if err := writeUint32(b, offsetRoot); err != nil {
 		return err
 	}
 	// size of root block
-	if err := binary.Write(b, binary.BigEndian, size); err != nil {
+	if err := writeUint32(b, size); err != nil {
 		return err
 	}
 	// offset of root block
-	if err := binary.Write(b, binary.BigEndian, offsetRoot); err != nil {
+	if err := writeUint32(b, offsetRoot); err != nil {
 		return err
 	}
 	// write extra
@@ -328,75 +389,127 @@ func (s *Store) writeHeader(b *bytes.Buffer, offsetRoot, size uint32) error {
 	return nil
 }
 
-// WriteStore writes .DS_Store to io.Writer
+// Write writes .DS_Store to io.Writer
 func (s *Store) Write(w io.Writer) error {
-	// prepare data block
-	blockData := new(bytes.Buffer)
-	if err := s.writeBlockData(blockData, s.Records); err != nil {
-		return err
+	// try to keep the layout of the file which was read
+	if s.PreserveLayout && s.layout != nil {
+		b := new(bytes.Buffer)
+		err := s.writeLayout(b)
+		if err == nil {
+			_, err = w.Write(b.Bytes())
+			return err
+		}
+		if err != errLayoutChanged {
+			return err
+		}
 	}
-	// prepare DSDB block (always 2 index)
+	// encode records in Finder order
+	records := make([][]byte, len(s.Records))
+	for i, r := range sortRecords(s.Records) {
+		b := new(bytes.Buffer)
+		if err := s.writeRecord(b, r); err != nil {
+			return err
+		}
+		records[i] = b.Bytes()
+	}
+	// block indices. blocks of unknown topics keep their indices,
+	// root block, DSDB block and nodes take the lowest free indices
+	root, levels, count := s.writeTree(records)
+	topicBlocks := s.writeTopicBlocks()
+	reserved := s.writeReserved(topicBlocks)
+	indices := s.writeIndices(reserved, 2+int(count))
+	indexRoot, indexDSDB := indices[0], indices[1]
+	// prepare B-tree blocks
+	nodes := s.writeTreeIndex(root, indices[2:])
+	blockNodes := make([]*bytes.Buffer, len(nodes))
+	for i, n := range nodes {
+		blockNodes[i] = new(bytes.Buffer)
+		if err := s.writeBlockNode(blockNodes[i], n); err != nil {
+			return err
+		}
+	}
+	// prepare DSDB block
 	blockDSDB := new(bytes.Buffer)
-	if err := s.writeBlockDSDB(blockDSDB, 2); err != nil {
+	if err := s.writeBlockDSDB(blockDSDB, root.index, levels, count); err != nil {
 		return err
 	}
 	// prepare Root block
-	blockList := s.writeFreeMapCreate()
-	blockRoot := new(bytes.Buffer)
-	if err := s.writeBlockRoot(blockRoot, 0, 0, 0, blockList); err != nil {
-		return err
+	offsetsCount := indices[len(indices)-1] + 1
+	topicIndices := make([]uint32, 0, len(topicBlocks))
+	for index := range topicBlocks {
+		topicIndices = append(topicIndices, index)
+		if index >= offsetsCount {
+			offsetsCount = index + 1
+		}
 	}
-	// align blocks
-	if err := s.writeAlignBlock(blockData, 32); err != nil {
-		return err
+	sort.Slice(topicIndices, func(i, j int) bool {
+		return topicIndices[i] < topicIndices[j]
+	})
+	offsets := make([]uint32, offsetsCount)
+	// allocate blocks. Finder allocates the whole page for every node
+	allocator := NewAllocator()
+	var err error
+	for i, blockNode := range blockNodes {
+		size := uint32(blockNode.Len())
+		if size < nodePageSize {
+			size = nodePageSize
+		}
+		if offsets[nodes[i].index], err = allocator.Alloc(size); err != nil {
+			return err
+		}
 	}
-	if err := s.writeAlignBlock(blockDSDB, 32); err != nil {
-		return err
+	for _, index := range topicIndices {
+		if offsets[index], err = allocator.Alloc(uint32(len(topicBlocks[index]))); err != nil {
+			return err
+		}
 	}
-	if err := s.writeAlignBlock(blockRoot, 32); err != nil {
+	if offsets[indexDSDB], err = allocator.Alloc(uint32(blockDSDB.Len())); err != nil {
 		return err
 	}
-	// create blocks map
-	blockDataOffset, blockList := s.writeFreeMapAlloc(blockList, uint32(blockData.Len()), 0)
-	blockDSDBOffset, blockList := s.writeFreeMapAlloc(blockList, uint32(blockDSDB.Len()), 0)
-	blockRootOffset, blockList := s.writeFreeMapAlloc(blockList, uint32(blockRoot.Len()), 0)
-	// calc real offset
-	blockDataOffsetReal := blockOffset(blockDataOffset)
-	blockDSDBOffsetReal := blockOffset(blockDSDBOffset)
-	blockRootOffsetReal := blockOffset(blockRootOffset)
-	// calc end of blocks
-	blockDataEnd := blockDataOffsetReal + blockSize(blockDataOffset)
-	blockDSDBEnd := blockDSDBOffsetReal + blockSize(blockDSDBOffset)
-	blockRootEnd := blockRootOffsetReal + blockSize(blockRootOffset)
-	// re-create root block with correct offsets
-	blockRoot.Reset()
-	if err := s.writeBlockRoot(blockRoot, blockRootOffset, blockDSDBOffset, blockDataOffset, blockList); err != nil {
-		return err
+	// root block keeps the free list, so allocate it until it fits
+	blockRoot := new(bytes.Buffer)
+	for {
+		blockRoot.Reset()
+		if err := s.writeBlockRoot(blockRoot, offsets, indexDSDB, allocator); err != nil {
+			return err
+		}
+		if offsets[indexRoot] != 0 {
+			if uint32(blockRoot.Len()) <= blockSize(offsets[indexRoot]) {
+				break
+			}
+			if err := allocator.Free(offsets[indexRoot]); err != nil {
+				return err
+			}
+		}
+		if offsets[indexRoot], err = allocator.Alloc(uint32(blockRoot.Len())); err != nil {
+			return err
+		}
 	}
 	// write header
 	blockHeader := new(bytes.Buffer)
-	if err := s.writeHeader(blockHeader, blockRootOffsetReal, uint32(blockRoot.Len())); err != nil {
+	if err := s.writeHeader(blockHeader, blockOffset(offsets[indexRoot]), uint32(blockRoot.Len())); err != nil {
 		return err
 	}
 	// calculate file size
 	var size uint32 = 32
-	if blockRootEnd > size {
-		size = blockRootEnd
-	}
-	if blockDSDBEnd > size {
-		size = blockDSDBEnd
-	}
-	if blockDataEnd > size {
-		size = blockDataEnd
+	for _, offset := range offsets {
+		if end := blockOffset(offset) + blockSize(offset); end > size {
+			size = end
+		}
 	}
 	// create full file
 	fileData := make([]byte, size+4)
 	copy(fileData[0:], blockHeader.Bytes())
-	copy(fileData[4+blockRootOffsetReal:], blockRoot.Bytes())
-	copy(fileData[4+blockDSDBOffsetReal:], blockDSDB.Bytes())
-	copy(fileData[4+blockDataOffsetReal:], blockData.Bytes())
+	copy(fileData[4+blockOffset(offsets[indexRoot]):], blockRoot.Bytes())
+	copy(fileData[4+blockOffset(offsets[indexDSDB]):], blockDSDB.Bytes())
+	for i, blockNode := range blockNodes {
+		copy(fileData[4+blockOffset(offsets[nodes[i].index]):], blockNode.Bytes())
+	}
+	for _, index := range topicIndices {
+		copy(fileData[4+blockOffset(offsets[index]):], topicBlocks[index])
+	}
 	// write it
-	_, err := w.Write(fileData)
+	_, err = w.Write(fileData)
 	return err
 }
 